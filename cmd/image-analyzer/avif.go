@@ -0,0 +1,6 @@
+//go:build avif
+
+package main
+
+// Built with -tags avif, the CLI writes and reads avif through libavif
+import _ "github.com/menta2k/image-analyzer/pkg/avif"
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs main instead of the tests when runCLI re-executes the test binary
+func TestMain(m *testing.M) {
+	if os.Getenv("IMAGE_ANALYZER_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCLI runs the command with args in a subprocess and returns its combined output
+func runCLI(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "IMAGE_ANALYZER_RUN_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// cliAnalysis is the fake model's answer: a centered subject
+const cliAnalysis = `{"primary":{"label":"dog","confidence":0.9,"box":{"x":0.3,"y":0.3,"w":0.4,"h":0.4},"cx":0.5,"cy":0.5},"description":"a dog","tags":["dog"]}`
+
+// fakeModelServer is a llama.cpp server that answers every chat completion with cliAnalysis
+func fakeModelServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":%q}}]}`, cliAnalysis)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// cliTestImage returns a w x h textured image
+func cliTestImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8((x * y) % 251), 255})
+		}
+	}
+	return img
+}
+
+// cliInputPNG writes cliTestImage(w, h) as a PNG into a temp dir and returns its path
+func cliInputPNG(t *testing.T, w, h int) string {
+	img := cliTestImage(w, h)
+	path := filepath.Join(t.TempDir(), "input.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// outputFiles maps the base name of every file under dir to its size
+func outputFiles(t *testing.T, dir string) map[string]int64 {
+	files := map[string]int64{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[d.Name()] = info.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestQualitySet(t *testing.T) {
+	srv := fakeModelServer(t)
+	out := t.TempDir()
+	if log, err := runCLI(t, "-in", cliInputPNG(t, 400, 300), "-url", srv.URL, "-out", out, "-quality-set", "95,40,70,40"); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	files := outputFiles(t, out)
+	var sizes []int64
+	for _, q := range []int{40, 70, 95} {
+		name := fmt.Sprintf("001_1200x675_A_q%d.jpg", q)
+		size, ok := files[name]
+		if !ok {
+			t.Fatalf("%s missing from %v", name, files)
+		}
+		sizes = append(sizes, size)
+	}
+	if !(sizes[0] < sizes[1] && sizes[1] < sizes[2]) {
+		t.Errorf("sizes at q40, q70, q95: %v, want increasing", sizes)
+	}
+	if _, ok := files["001_1200x675_A.jpg"]; ok {
+		t.Error("a crop without a quality suffix was written")
+	}
+
+	if log, err := runCLI(t, "-in", cliInputPNG(t, 40, 30), "-url", srv.URL, "-out", t.TempDir(), "-quality-set", "80,0"); err == nil {
+		t.Errorf("quality 0 was accepted:\n%s", log)
+	}
+}
+
+func TestDedupeCrops(t *testing.T) {
+	srv := fakeModelServer(t)
+	in := cliInputPNG(t, 400, 300)
+
+	all := t.TempDir()
+	if log, err := runCLI(t, "-in", in, "-url", srv.URL, "-out", all); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	deduped := t.TempDir()
+	if log, err := runCLI(t, "-in", in, "-url", srv.URL, "-out", deduped, "-dedupe-crops"); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+
+	// 600x400 has the ratio of 1200x800 and the same content, so only it is skipped
+	const dup = "004_600x400_A.jpg"
+	allFiles, dedupedFiles := outputFiles(t, all), outputFiles(t, deduped)
+	if _, ok := allFiles[dup]; !ok {
+		t.Fatalf("%s missing without -dedupe-crops: %v", dup, allFiles)
+	}
+	if _, ok := dedupedFiles[dup]; ok {
+		t.Errorf("%s written with -dedupe-crops", dup)
+	}
+	for name := range allFiles {
+		if _, ok := dedupedFiles[name]; !ok && name != dup {
+			t.Errorf("%s skipped with -dedupe-crops", name)
+		}
+	}
+}
+
+func TestInputURLs(t *testing.T) {
+	model := fakeModelServer(t)
+	var img bytes.Buffer
+	if err := png.Encode(&img, cliTestImage(200, 150)); err != nil {
+		t.Fatal(err)
+	}
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img.Bytes())
+	}))
+	defer images.Close()
+
+	list := filepath.Join(t.TempDir(), "urls.txt")
+	urls := "# product shots\n" + images.URL + "/shots/red.png\n\n" + images.URL + "/missing.png\n" + images.URL + "/shots/blue.png\n"
+	if err := os.WriteFile(list, []byte(urls), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	log, err := runCLI(t, "-input-urls", list, "-url", model.URL, "-out", out, "-concurrency", "2", "-http-timeout", "5s")
+	// The missing image fails the run without stopping the other two
+	if err == nil || !strings.Contains(log, "1 of 3 inputs failed") {
+		t.Fatalf("want one failed input, got %v\n%s", err, log)
+	}
+	for _, stem := range []string{"red", "blue"} {
+		if _, err := os.Stat(filepath.Join(out, stem, "001_1200x675_A.jpg")); err != nil {
+			t.Errorf("%s: %v\n%s", stem, err, log)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "missing")); err == nil {
+		if files := outputFiles(t, filepath.Join(out, "missing")); len(files) > 0 {
+			t.Errorf("the failed download wrote %v", files)
+		}
+	}
+
+	if log, err := runCLI(t, "-input-urls", list, "-url", model.URL, "-out", out, "-concurrency", "0"); err == nil {
+		t.Errorf("-concurrency 0 was accepted:\n%s", log)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/menta2k/image-analyzer/pkg/processing"
+)
+
+// readURLList reads newline-delimited image URLs from a file; blank lines and # comments are skipped
+func readURLList(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var urls []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !isURL(line) {
+			return nil, fmt.Errorf("%s:%d: not an http(s) URL: %q", name, n, line)
+		}
+		urls = append(urls, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// imageExtensions are the input file extensions picked up from directories and globs
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".webp": true,
+	".svg":  true,
+	".gif":  true,
+	".bmp":  true,
+	".tif":  true,
+	".tiff": true,
+}
+
+func init() {
+	for ext := range processing.RAWExtensions {
+		imageExtensions[ext] = true
+	}
+}
+
+// formatExtensions maps input format names to the file extensions they cover
+var formatExtensions = map[string][]string{
+	"jpg":  {".jpg", ".jpeg"},
+	"jpeg": {".jpg", ".jpeg"},
+	"tif":  {".tif", ".tiff"},
+	"tiff": {".tif", ".tiff"},
+}
+
+// parseInputFormats parses a comma-separated -input-format list (e.g. "png,jpg") into the set of
+// accepted file extensions; formats must be decodable by this build. Empty accepts everything.
+func parseInputFormats(s string) (map[string]bool, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	supported := map[string]bool{"jpeg": true}
+	for _, f := range processing.SupportedInputFormats() {
+		supported[f] = true
+	}
+	supported["tif"] = supported["tiff"]
+	for ext := range processing.RAWExtensions {
+		supported[strings.TrimPrefix(ext, ".")] = true
+	}
+	exts := map[string]bool{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(f)), ".")
+		if f == "" {
+			continue
+		}
+		if !supported[f] {
+			return nil, fmt.Errorf("unsupported input format %q", f)
+		}
+		if alias, ok := formatExtensions[f]; ok {
+			for _, ext := range alias {
+				exts[ext] = true
+			}
+			continue
+		}
+		exts["."+f] = true
+	}
+	return exts, nil
+}
+
+// filterInputFormats keeps the files whose extension is in exts; URLs are kept as they carry no
+// reliable extension. A nil exts keeps every input.
+func filterInputFormats(inputs []string, exts map[string]bool) []string {
+	if exts == nil {
+		return inputs
+	}
+	var out []string
+	for _, in := range inputs {
+		if isURL(in) || exts[strings.ToLower(filepath.Ext(in))] {
+			out = append(out, in)
+		}
+	}
+	return out
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// byteSize is a flag holding a size such as 500MB, 1.5G or 4096 (binary units: 1K = 1024)
+type byteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	mult   float64
+}{
+	{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+func (b *byteSize) String() string {
+	if *b == 0 {
+		return "0"
+	}
+	return formatSize(int64(*b))
+}
+
+func (b *byteSize) Set(v string) error {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	mult := 1.0
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q (e.g. 500MB, 2G, 4096)", v)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// formatSize renders a byte count with a binary unit, e.g. 1.5 MB
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, unit := float64(n)/1024, "KB"
+	for _, u := range []string{"MB", "GB", "TB"} {
+		if f < 1024 {
+			break
+		}
+		f, unit = f/1024, u
+	}
+	return fmt.Sprintf("%.1f %s", f, unit)
+}
+
+// expandPath expands a leading ~ to the user's home directory and $VAR / ${VAR} references
+// (unset variables become empty); URLs are returned unchanged
+func expandPath(p string) (string, error) {
+	if p == "" || isURL(p) {
+		return p, nil
+	}
+	p = os.ExpandEnv(p)
+	if p == "~" || strings.HasPrefix(p, "~/") || (filepath.Separator == '\\' && strings.HasPrefix(p, `~\`)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("cannot expand %q: %v", p, err)
+		}
+		p = filepath.Join(home, p[1:])
+	}
+	return p, nil
+}
+
+// isURL reports whether an input refers to a remote image
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// expandInputs resolves URLs, files, directories and glob patterns (including **)
+// into a de-duplicated list of inputs, preserving the order they were given in
+func expandInputs(patterns []string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+
+	for _, pattern := range patterns {
+		// Existing paths are taken literally, even with glob characters like "[" in their name
+		_, statErr := os.Stat(pattern)
+		switch {
+		case isURL(pattern):
+			add(pattern)
+		case statErr != nil && strings.ContainsAny(pattern, "*?["):
+			matches, err := globInputs(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+			}
+			for _, m := range matches {
+				add(m)
+			}
+		default:
+			info, err := os.Stat(pattern)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(pattern)
+				continue
+			}
+			entries, err := os.ReadDir(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if !e.IsDir() && imageExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+					add(filepath.Join(pattern, e.Name()))
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// globInputs expands a glob pattern; a "**" path element matches any number of directories
+// and, like a directory input, only picks up files with an image extension
+func globInputs(pattern string) ([]string, error) {
+	idx := strings.Index(pattern, "**")
+	if idx < 0 {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && !info.IsDir() {
+				files = append(files, m)
+			}
+		}
+		return files, nil
+	}
+
+	root := filepath.Clean(pattern[:idx])
+	if pattern[:idx] == "" {
+		root = "."
+	}
+	rest := strings.TrimLeft(pattern[idx+2:], `/\`)
+	if rest == "" {
+		rest = "*"
+	}
+	if _, err := filepath.Match(rest, ""); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !imageExtensions[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		// Try the remaining pattern against every trailing part of the relative path
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		for i := range parts {
+			if ok, _ := path.Match(filepath.ToSlash(rest), strings.Join(parts[i:], "/")); ok {
+				files = append(files, p)
+				break
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// outputDirs returns the output directory for each input: base itself for a single
+// input, otherwise a sub-directory per input named after its file name
+func outputDirs(inputs []string, base string) []string {
+	dirs := make([]string, len(inputs))
+	if len(inputs) == 1 {
+		dirs[0] = base
+		return dirs
+	}
+	used := map[string]int{}
+	for i, in := range inputs {
+		stem := inputStem(in)
+		used[stem]++
+		if used[stem] > 1 {
+			stem = fmt.Sprintf("%s_%d", stem, used[stem])
+		}
+		dirs[i] = filepath.Join(base, stem)
+	}
+	return dirs
+}
+
+// inputStem is the base name of an input path or URL path without its extension
+func inputStem(in string) string {
+	name := in
+	if isURL(in) {
+		if u, err := url.Parse(in); err == nil {
+			name = u.Path
+		}
+	}
+	stem := strings.TrimSuffix(path.Base(filepath.ToSlash(name)), path.Ext(name))
+	if stem == "" || stem == "." || stem == "/" {
+		stem = "image"
+	}
+	return stem
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseInputFormats(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"png, JPG", []string{".jpeg", ".jpg", ".png"}, false},
+		{".webp", []string{".webp"}, false},
+		{"tif", []string{".tif", ".tiff"}, false},
+		{"tiff,gif,bmp", []string{".bmp", ".gif", ".tif", ".tiff"}, false},
+		{"heic", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			exts, err := parseInputFormats(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for ext := range exts {
+				got = append(got, ext)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// touch creates empty files below dir
+func touch(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpandInputsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "a.jpg", "b.gif", "c.bmp", "d.tif", "e.TIFF", "notes.txt", "f.svg")
+	got, err := expandInputs([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		got[i] = filepath.Base(got[i])
+	}
+	sort.Strings(got)
+	want := []string{"a.jpg", "b.gif", "c.bmp", "d.tif", "e.TIFF", "f.svg"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExpandInputsGlobs(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "a.jpg", "b.png", "notes.txt", "sub/c.jpg", "sub/deep/d.webp", "sub/deep/e.json", "photo[1].jpg")
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+	}{
+		{"glob", "*.jpg", []string{"a.jpg", "photo[1].jpg"}},
+		{"recursive", "**", []string{"a.jpg", "b.png", "photo[1].jpg", "sub/c.jpg", "sub/deep/d.webp"}},
+		{"recursive with pattern", "sub/**/*.jpg", []string{"sub/c.jpg"}},
+		// "[1]" would otherwise be a character class matching "photo1.jpg" only
+		{"literal path with brackets", "photo[1].jpg", []string{"photo[1].jpg"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandInputs([]string{filepath.Join(dir, tt.pattern)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range got {
+				rel, err := filepath.Rel(dir, got[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[i] = filepath.ToSlash(rel)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// job is one line of -jobs input; unset fields fall back to the command line flags
+type job struct {
+	ID      string   `json:"id,omitempty"`      // echoed in the result line, default the job's line number
+	URL     string   `json:"url,omitempty"`     // input http(s) URL, or
+	Path    string   `json:"path,omitempty"`    // input file
+	Sizes   []string `json:"sizes,omitempty"`   // target sizes as WxH, e.g. "1080x1080"
+	Format  string   `json:"format,omitempty"`  // output format, like -ext
+	Quality int      `json:"quality,omitempty"` // output quality, like -quality
+	Out     string   `json:"out,omitempty"`     // output directory relative to -out, default job_<id>
+}
+
+// maxJobLine is the longest -jobs line accepted
+const maxJobLine = 1 << 20
+
+// openJobs opens the -jobs source, "-" being stdin
+func openJobs(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// runJobs processes newline-delimited JSON jobs from in, up to -concurrency at a time, and
+// writes one fileReport line per job to out as it completes. It returns how many jobs were
+// read and how many failed.
+func (r *runner) runJobs(in io.Reader, out io.Writer) (total, failed int, err error) {
+	batchCtx, stopBatch := context.WithCancel(context.Background())
+	defer stopBatch()
+	r.stopBatch = stopBatch
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	enc := json.NewEncoder(out)
+	emit := func(rep *fileReport, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			failed++
+		}
+		if err := enc.Encode(rep); err != nil {
+			log.Printf("jobs: %v", err)
+		}
+	}
+
+	sem := make(chan struct{}, r.o.concurrency)
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), maxJobLine)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		total++
+		// Unknown fields fail the job rather than being silently ignored
+		var j job
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&j); err != nil {
+			err = fmt.Errorf("invalid job %d: %v", total, err)
+			emit(&fileReport{ID: strconv.Itoa(total), Status: "failed", Error: err.Error()}, err)
+			continue
+		}
+		if j.ID == "" {
+			j.ID = strconv.Itoa(total)
+		}
+		jr, source, dir, err := r.forJob(j)
+		if err != nil {
+			emit(&fileReport{ID: j.ID, Source: source, Status: "failed", Error: err.Error()}, err)
+			continue
+		}
+
+		sem <- struct{}{}
+		if batchCtx.Err() != nil {
+			<-sem
+			emit(&fileReport{ID: j.ID, Source: source, Status: "stopped", Error: "stopped by -max-output-size"}, nil)
+			continue
+		}
+		wg.Add(1)
+		go func(id, source, dir string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			rep, err := jr.runInput(batchCtx, source, dir)
+			rep.ID = id
+			emit(rep, err)
+		}(j.ID, source, dir)
+	}
+	wg.Wait()
+	if err := sc.Err(); err != nil {
+		return total, failed, fmt.Errorf("reading jobs: %v", err)
+	}
+	return total, failed, nil
+}
+
+// forJob returns a copy of the runner with the job's overrides applied, along with the
+// job's input and output directory
+func (r *runner) forJob(j job) (*runner, string, string, error) {
+	source := j.URL
+	if source != "" && !isURL(source) {
+		return nil, source, "", fmt.Errorf("url %q is not an http or https URL", source)
+	}
+	if j.Path != "" {
+		if source != "" {
+			return nil, source, "", fmt.Errorf("job sets both url and path")
+		}
+		p, err := expandPath(j.Path)
+		if err != nil {
+			return nil, j.Path, "", err
+		}
+		source = p
+	}
+	if source == "" {
+		return nil, "", "", fmt.Errorf("job has neither url nor path")
+	}
+
+	jr := *r
+	if j.Format != "" {
+		if err := checkOutputFormat(j.Format); err != nil {
+			return nil, source, "", fmt.Errorf("format: %v", err)
+		}
+		jr.o.ext = strings.ToLower(j.Format)
+		jr.extByRatio = nil
+	}
+	if j.Quality != 0 {
+		if j.Quality < 1 || j.Quality > 100 {
+			return nil, source, "", fmt.Errorf("quality %d is not between 1 and 100", j.Quality)
+		}
+		jr.qualities = []int{j.Quality}
+		jr.qualitySet = false
+	}
+	if len(j.Sizes) > 0 {
+		jr.targetSizes = nil
+		for _, s := range j.Sizes {
+			ws, hs, ok := strings.Cut(strings.ToLower(strings.TrimSpace(s)), "x")
+			w, errW := strconv.Atoi(ws)
+			h, errH := strconv.Atoi(hs)
+			if !ok || errW != nil || errH != nil || w <= 0 || h <= 0 {
+				return nil, source, "", fmt.Errorf("size %q is not WxH", s)
+			}
+			jr.targetSizes = append(jr.targetSizes, [2]int{w, h})
+		}
+	}
+
+	// Jobs may come from untrusted producers, so out stays below -out
+	out := j.Out
+	if out == "" {
+		out = "job_" + strings.Trim(unsafeFilenameChars.ReplaceAllString(j.ID, "_"), "._")
+	} else if !filepath.IsLocal(out) {
+		return nil, source, "", fmt.Errorf("out %q must be a relative path inside -out", j.Out)
+	}
+	return &jr, source, filepath.Join(r.o.outDir, out), nil
+}
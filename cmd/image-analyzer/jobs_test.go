@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestForJob(t *testing.T) {
+	r := &runner{o: options{outDir: "out", ext: "jpg"}}
+	tests := []struct {
+		name       string
+		job        job
+		wantSource string
+		wantDir    string
+		wantErr    bool
+	}{
+		{"url", job{ID: "a1", URL: "https://example.com/cat.jpg"}, "https://example.com/cat.jpg", filepath.Join("out", "job_a1"), false},
+		{"path", job{ID: "2", Path: "photos/dog.png", Out: "dog"}, "photos/dog.png", filepath.Join("out", "dog"), false},
+		{"nested out", job{ID: "3", Path: "a.jpg", Out: "x/../y/z"}, "a.jpg", filepath.Join("out", "y", "z"), false},
+		{"unsafe id", job{ID: "../../etc", Path: "a.jpg"}, "a.jpg", filepath.Join("out", "job_etc"), false},
+		// A local file given as url must not be read from disk
+		{"url is a path", job{ID: "4", URL: "/etc/passwd"}, "", "", true},
+		{"url is file://", job{ID: "5", URL: "file:///etc/passwd"}, "", "", true},
+		{"out escapes", job{ID: "6", Path: "a.jpg", Out: "../elsewhere"}, "", "", true},
+		{"out absolute", job{ID: "7", Path: "a.jpg", Out: "/tmp/x"}, "", "", true},
+		{"url and path", job{ID: "8", URL: "https://example.com/a.jpg", Path: "a.jpg"}, "", "", true},
+		{"neither", job{ID: "9"}, "", "", true},
+		{"bad format", job{ID: "10", Path: "a.jpg", Format: "gif"}, "", "", true},
+		{"bad size", job{ID: "11", Path: "a.jpg", Sizes: []string{"10by10"}}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, source, dir, err := r.forJob(tt.job)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if source != tt.wantSource || dir != tt.wantDir {
+				t.Errorf("got (%q, %q), want (%q, %q)", source, dir, tt.wantSource, tt.wantDir)
+			}
+		})
+	}
+}
+
+func TestRunJobs(t *testing.T) {
+	sink := &fakeSink{}
+	r := testRunner(t, sink, [2]int{32, 32})
+	in := writeTestPNG(t, 96, 64)
+	jobs := fmt.Sprintf(`{"id":"ok","path":%q,"sizes":["48x24"]}`+"\n"+
+		`{"id":"ratios","path":%q,"ratios":["square"],"format":"webp"}`+"\n", in, in)
+
+	var out bytes.Buffer
+	total, failed, err := r.runJobs(strings.NewReader(jobs), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || failed != 1 {
+		t.Errorf("total %d, failed %d; want 2 and 1", total, failed)
+	}
+
+	// Reports arrive in completion order, so key them by id
+	reports := map[string]fileReport{}
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var rep fileReport
+		if err := dec.Decode(&rep); err != nil {
+			t.Fatal(err)
+		}
+		reports[rep.ID] = rep
+	}
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want 2: %v", len(reports), reports)
+	}
+	if rep := reports["ok"]; rep.Status != "ok" || len(rep.Outputs) != 1 || !strings.Contains(rep.Outputs[0], "48x24") {
+		t.Errorf("job ok: %+v, want status ok and one 48x24 output", rep)
+	}
+	// An unsupported field must fail the job instead of being dropped
+	if rep := reports["2"]; rep.Status != "failed" || !strings.Contains(rep.Error, `unknown field "ratios"`) {
+		t.Errorf("job with ratios: %+v, want failed on the unknown field", rep)
+	}
+}
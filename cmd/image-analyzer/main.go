@@ -3,19 +3,118 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image"
+	"io"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
 
+	"github.com/disintegration/imaging"
 	"github.com/menta2k/image-analyzer/pkg/client"
 	"github.com/menta2k/image-analyzer/pkg/detection"
 	"github.com/menta2k/image-analyzer/pkg/llamacpp"
 	"github.com/menta2k/image-analyzer/pkg/ollama"
 	"github.com/menta2k/image-analyzer/pkg/processing"
+	"github.com/menta2k/image-analyzer/pkg/storage"
 	"github.com/menta2k/image-analyzer/pkg/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records a span per crop; it is a no-op unless an OpenTelemetry provider is installed
+var tracer = otel.Tracer("github.com/menta2k/image-analyzer/cmd/image-analyzer")
+
+// claheTiles is the tile grid size used by -clahe
+const claheTiles = 8
+
+// atlasMaxWidth is the maximum width of the -atlas image
+const atlasMaxWidth = 4096
+
+// augmentations are the -augment variants saved alongside each crop
+var augmentations = map[string]struct {
+	marker string // inserted before the file extension
+	apply  func(image.Image) image.Image
+}{
+	"flip-h": {"_fliph", func(img image.Image) image.Image { return imaging.FlipH(img) }},
+	"flip-v": {"_flipv", func(img image.Image) image.Image { return imaging.FlipV(img) }},
+}
+
+// parseAugment parses the comma-separated -augment list
+func parseAugment(s string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		a := strings.ToLower(strings.TrimSpace(part))
+		if a == "" || seen[a] {
+			continue
+		}
+		if _, ok := augmentations[a]; !ok {
+			return nil, fmt.Errorf("unknown augmentation %q (use flip-h, flip-v)", part)
+		}
+		seen[a] = true
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// fileReport is the -jsonl line written for each input as it completes
+type fileReport struct {
+	ID         string   `json:"id,omitempty"` // job id in -jobs mode
+	Source     string   `json:"source"`
+	Status     string   `json:"status"` // ok, failed, timeout, stopped or skipped
+	Error      string   `json:"error,omitempty"`
+	Label      string   `json:"label,omitempty"`
+	Confidence float64  `json:"confidence,omitempty"`
+	Outputs    []string `json:"outputs,omitempty"` // crops, thumbnail or coords sidecar written
+}
+
+// cropCoords is one entry of the -coords-only sidecar
+type cropCoords struct {
+	Width  int       `json:"width"`
+	Height int       `json:"height"`
+	Box    types.Box `json:"box"`              // normalized crop rect in the source image
+	Padded bool      `json:"padded,omitempty"` // whole image is resized and padded (-full-frame, -crop-mode)
+	// SourceRect is Box in source pixels, the region an editor would show and adjust
+	SourceRect pixelRect `json:"source_rect"`
+	// SubjectCoverage is the fraction of the detected subject's area inside the crop
+	SubjectCoverage float64 `json:"subject_coverage"`
+}
+
+// pixelRect is a rectangle in source image pixels
+type pixelRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// atlasEntry is the position of one crop in the -atlas image
+type atlasEntry struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// Near-duplicate thresholds for -dedupe-crops
+const (
+	dedupeRatioTolerance = 0.05 // relative aspect ratio difference
+	dedupeHashDistance   = 4    // max differing bits of the average hash
 )
 
 // Default target sizes for cropping
@@ -27,100 +126,877 @@ var defaultTargetSizes = [][2]int{
 	{1200, 630},
 }
 
-func main() {
-	var in, outDir, model, url, ext string
-	var backend string
-	var quality int
-	var lossless bool
-	var sendFmt string
-	var sendSize int
-	var sendQ int
-	var zoom float64
-	var debug bool
+// profile is a named preset that overrides several flags at once
+type profile struct {
+	flags map[string]string // flag name -> value, applied unless given explicitly
+	sizes [][2]int          // target sizes, nil = defaultTargetSizes
+}
+
+// profiles are the presets selectable with -profile
+var profiles = map[string]profile{
+	"web": {
+		flags: map[string]string{"ext": "webp", "quality": "82"},
+		sizes: [][2]int{{1200, 675}, {1200, 800}, {600, 400}},
+	},
+	"print": {
+		flags: map[string]string{"ext": "jpg", "quality": "98", "sendsize": "2048"},
+		sizes: [][2]int{{3000, 2000}, {2400, 3000}},
+	},
+	"social": {
+		flags: map[string]string{"ext": "jpg", "quality": "85"},
+		sizes: [][2]int{{1080, 1080}, {1080, 1350}, {1200, 630}, {1080, 1920}},
+	},
+}
+
+// options holds the command line flags
+type options struct {
+	inputs                  stringList
+	inputURLs               string
+	inputFormat             string
+	jobs                    string
+	httpTimeout             time.Duration
+	concurrency             int
+	fileTimeout             time.Duration
+	maxOutputSize           byteSize
+	maxDecoded              int
+	poolBuffers             bool
+	maxRequests             int
+	outDir, model, url, ext string
+	output                  string
+	backend                 string
+	ollamaOpts              stringList
+	exclude                 stringList
+	keepAlive               time.Duration
+	chatPath                string
+	modelTimeout            time.Duration
+	quality                 int
+	qualitySetFlag          string
+	lossless                bool
+	autoLossless            bool
+	extByRatio              string
+	sendFmt                 string
+	sendSize                int
+	sendQ                   int
+	clahe                   float64
+	zoom                    float64
+	anchor                  string
+	cropMode                string
+	maxCropLoss             float64
+	headroom                float64
+	sharpen                 float64
+	grayscale               bool
+	colorTag                bool
+	theme                   bool
+	augment                 string
+	deskew                  float64
+	fullFrame               float64
+	centerTol               float64
+	labels                  string
+	lang                    string
+	thumbnail               int
+	svgSize                 int
+	allowPartial            bool
+	allowThumbnailOnly      bool
+	pngColor                string
+	tagSRGB                 bool
+	allowHosts              string
+	blockPrivate            bool
+	debug                   bool
+	dedupe                  bool
+	atlas                   bool
+	annotate                bool
+	explain                 bool
+	jsonl                   bool
+	formats                 bool
+	coordsOnly              bool
+	profile                 string
+	nameTemplate            string
+	tagFilenames            bool
+	preserveMtime           bool
 
 	// Debug overlay format (separate from crop ext)
-	var dbgext string
-	var dbgquality int
-	var dbglossless bool
+	dbgext      string
+	dbgquality  int
+	dbglossless bool
+}
 
-	flag.StringVar(&in, "in", "", "input image path or URL (jpg/png/webp)")
-	flag.StringVar(&outDir, "out", "out", "output directory")
-	flag.StringVar(&model, "model", "openbmb/minicpm-v4.5", "model name")
-	flag.StringVar(&backend, "backend", "llamacpp", "backend to use: ollama or llamacpp")
-	flag.StringVar(&url, "url", "", "server URL (defaults: ollama=http://localhost:11435/api/chat, llamacpp=http://localhost:8080)")
+func main() {
+	var o options
 
-	flag.StringVar(&ext, "ext", "jpg", "output format for crops: jpg|png|webp")
-	flag.IntVar(&quality, "quality", 90, "JPEG/WebP output quality for crops (1-100)")
-	flag.BoolVar(&lossless, "lossless", false, "WebP output lossless mode for crops")
+	flag.Var(&o.inputs, "in", "input image path, URL, directory or glob (jpg/png/webp/svg/gif/bmp/tiff, RAW via embedded preview); repeatable")
+	flag.StringVar(&o.inputFormat, "input-format", "", "comma-separated input formats to process (e.g. png,jpg); other files are skipped, empty=all")
+	flag.StringVar(&o.jobs, "jobs", "", "read newline-delimited JSON jobs from this file (- = stdin) instead of -in and write one JSON result line per job")
+	flag.StringVar(&o.inputURLs, "input-urls", "", "file with one image URL per line to process in addition to -in")
+	flag.DurationVar(&o.httpTimeout, "http-timeout", processing.DefaultHTTPTimeout, "timeout for downloading each input URL")
+	flag.IntVar(&o.concurrency, "concurrency", 1, "number of inputs processed at the same time")
+	flag.Var(&o.maxOutputSize, "max-output-size", "stop the batch once the files written would exceed this total, e.g. 500MB (0=no limit)")
+	flag.DurationVar(&o.fileTimeout, "file-timeout", 0, "give up on an input after this long (load, detection and crops) and continue with the next, 0=no limit")
+	flag.IntVar(&o.maxDecoded, "max-decoded", 0, "max decoded images held in memory at once, 0=unlimited (one per -concurrency worker)")
+	flag.BoolVar(&o.poolBuffers, "pool-buffers", false, "reuse same-size debug overlay buffers across inputs to reduce GC pressure")
+	flag.IntVar(&o.maxRequests, "max-requests", 0, "max requests in flight to the model server, 0=unlimited")
+	flag.StringVar(&o.outDir, "out", "out", "output directory")
+	flag.StringVar(&o.output, "output", "", "upload outputs to s3://bucket/prefix instead of writing them under -out (credentials, region and endpoint from the AWS_* environment)")
+	flag.StringVar(&o.model, "model", "openbmb/minicpm-v4.5", "model name")
+	flag.StringVar(&o.backend, "backend", "llamacpp", "backend to use: ollama or llamacpp")
+	flag.Var(&o.ollamaOpts, "ollama-opt", "extra Ollama model option as key=value (e.g. seed=42, num_gpu=1); repeatable")
+	flag.DurationVar(&o.modelTimeout, "model-timeout", ollama.DefaultTimeout, "timeout for each vision model request, 0=no limit (see -file-timeout)")
+	flag.StringVar(&o.chatPath, "chat-path", llamacpp.DefaultChatPath, "llama.cpp chat completions path appended to -url (e.g. /api/v1/chat/completions behind a gateway)")
+	flag.DurationVar(&o.keepAlive, "keep-alive", 0, "how long Ollama keeps the model loaded after a request, 0=server default")
+	flag.StringVar(&o.profile, "profile", "", "named preset overriding format, quality and sizes: web|print|social")
+	flag.StringVar(&o.url, "url", "", "server URL (defaults: ollama=http://localhost:11435/api/chat, llamacpp=http://localhost:8080)")
 
-	flag.StringVar(&dbgext, "dbgext", "png", "debug overlay format: png|jpg|webp")
-	flag.IntVar(&dbgquality, "dbgquality", 92, "debug overlay quality (for jpg/webp)")
-	flag.BoolVar(&dbglossless, "dbglossless", false, "debug overlay WebP lossless mode")
+	flag.StringVar(&o.ext, "ext", "jpg", "output format for crops: "+strings.Join(processing.SupportedOutputFormats(), "|"))
+	flag.BoolVar(&o.tagFilenames, "tag-filenames", false, "put the detected label and top tag in crop filenames, e.g. 001_dog_pet_1200x675_A.jpg")
+	flag.BoolVar(&o.preserveMtime, "preserve-mtime", false, "give crops and thumbnails the input file's modification time (no-op for URL inputs)")
+	flag.StringVar(&o.nameTemplate, "name-template", "", "Go template for crop filenames with .name .index .w .h .ratio .variant .quality .ext .label .tag, e.g. '{{.name}}-{{.w}}x{{.h}}.{{.ext}}'")
+	flag.IntVar(&o.quality, "quality", 90, "JPEG/WebP output quality for crops (1-100)")
+	flag.StringVar(&o.qualitySetFlag, "quality-set", "", "comma-separated qualities to save each crop at, e.g. 60,80,95 (overrides -quality)")
+	flag.StringVar(&o.extByRatio, "ext-by-ratio", "", "output format per crop ratio overriding -ext, e.g. 1:1=webp,9:16=jpg")
+	flag.BoolVar(&o.lossless, "lossless", false, "WebP output lossless mode for crops")
+	flag.BoolVar(&o.autoLossless, "auto-lossless", false, "choose WebP lossless per crop: lossless for graphics/line art, lossy for photos")
 
-	flag.StringVar(&sendFmt, "sendfmt", "jpg", "format sent to Ollama: jpg|png")
-	flag.IntVar(&sendSize, "sendsize", 1536, "max long side sent to Ollama (px), 0=original")
-	flag.IntVar(&sendQ, "sendq", 85, "JPEG quality for image sent to Ollama (1-100)")
+	flag.StringVar(&o.dbgext, "dbgext", "png", "debug overlay format: png|jpg|webp")
+	flag.IntVar(&o.dbgquality, "dbgquality", 92, "debug overlay quality (for jpg/webp)")
+	flag.BoolVar(&o.dbglossless, "dbglossless", false, "debug overlay WebP lossless mode")
 
-	flag.Float64Var(&zoom, "zoom", 1.0, "shrink factor for crop size (0.01..1.0)")
-	flag.BoolVar(&debug, "debug", false, "create debug overlay images")
+	flag.StringVar(&o.sendFmt, "sendfmt", "jpg", "format sent to Ollama: jpg|png")
+	flag.IntVar(&o.sendSize, "sendsize", 1536, "max long side (px) of the copy sent to the model for detection, 0=original; crops are always cut from the full-resolution input")
+	flag.IntVar(&o.sendQ, "sendq", 85, "JPEG quality for image sent to Ollama (1-100)")
+	flag.Float64Var(&o.clahe, "clahe", 0, "CLAHE clip limit applied to the image sent to the model only, 0=off (e.g. 2)")
+
+	flag.Float64Var(&o.zoom, "zoom", 1.0, "shrink factor for crop size (0.01..1.0)")
+	flag.Var(&o.exclude, "exclude", "normalized x,y,w,h region crops should avoid (watermark, caption); repeatable")
+	flag.StringVar(&o.anchor, "anchor", "center", "where the subject sits in each crop: center|thirds|golden|portrait")
+	flag.StringVar(&o.cropMode, "crop-mode", "crop", "crop|pad|auto: pad keeps the whole image resized to fit and padded; auto pads when a crop would discard more than -max-crop-loss")
+	flag.Float64Var(&o.maxCropLoss, "max-crop-loss", types.DefaultMaxCropLoss, "with -crop-mode auto, largest share of the image a crop may discard (0-1)")
+	flag.Float64Var(&o.headroom, "headroom", processing.DefaultHeadroom, "with -anchor portrait, share of the crop height kept above the head (0-0.5)")
+	flag.Float64Var(&o.sharpen, "sharpen", 0, "unsharp mask sigma applied to crops after resizing, 0=off (e.g. 0.5)")
+	flag.Float64Var(&o.deskew, "deskew", 0, "straighten inputs tilted by up to this many degrees before cropping, 0=off (e.g. 5)")
+	flag.Float64Var(&o.fullFrame, "full-frame", 0, "resize and pad instead of cropping when the subject box covers at least this fraction of the image, 0=off (e.g. 0.8)")
+	flag.StringVar(&o.augment, "augment", "", "also save mirrored copies of each crop: flip-h,flip-v (files marked _fliph/_flipv)")
+	flag.BoolVar(&o.colorTag, "color-tag", false, "add the subject's dominant color name (e.g. red, navy) to the tags in model_output.json")
+	flag.BoolVar(&o.theme, "theme", false, "add the image's color theme (average color, dark/light, vivid/muted) to model_output.json")
+	flag.BoolVar(&o.grayscale, "grayscale", false, "convert crops to grayscale (Rec. 709 luma) before saving")
+	flag.Float64Var(&o.centerTol, "center-tol", detection.DefaultCenterTolerance, "max offset of subject center from image center (0..0.5, 0.5=unconstrained)")
+	flag.StringVar(&o.labels, "labels", "", "comma-separated subject labels to accept (e.g. person,car); other subjects are treated as none and cropped centered")
+	flag.StringVar(&o.lang, "lang", "", "language for the description and tags (e.g. Spanish); labels stay in English")
+	flag.IntVar(&o.svgSize, "svgsize", 0, "longest side (px) to rasterize SVG inputs at, 0=intrinsic size")
+	flag.BoolVar(&o.allowPartial, "allow-partial", false, "use the decoded part of truncated JPEGs instead of failing")
+	flag.BoolVar(&o.allowThumbnailOnly, "allow-thumbnail-only", false, "upscale the EXIF thumbnail of JPEGs whose main image does not decode to their EXIF size instead of failing")
+	flag.StringVar(&o.allowHosts, "allow-hosts", "", "comma-separated hosts URL inputs may be fetched from (.example.com allows subdomains)")
+	flag.BoolVar(&o.blockPrivate, "block-private", false, "refuse URL inputs that resolve to loopback, private or link-local addresses")
+	flag.StringVar(&o.pngColor, "png-color", "", "force the PNG color type of png outputs: rgb|rgb16|gray|gray16 (empty = keep source)")
+	flag.BoolVar(&o.tagSRGB, "tag-srgb", false, "mark jpg outputs (embedded ICC profile) and png outputs (sRGB chunk) as sRGB")
+	flag.IntVar(&o.thumbnail, "thumbnail", 0, "emit a thumbnail with this longest edge (px) instead of aspect-ratio crops, 0=off")
+	flag.BoolVar(&o.debug, "debug", false, "create debug overlay images")
+	flag.BoolVar(&o.annotate, "annotate", false, "also write 000_annotated.<dbgext>: the original with every crop rectangle drawn and labeled")
+	flag.BoolVar(&o.atlas, "atlas", false, "also pack all crops into atlas.<ext> with positions in atlas.json")
+	flag.BoolVar(&o.dedupe, "dedupe-crops", false, "skip crops that are near-duplicates of an already written crop")
+	flag.BoolVar(&o.coordsOnly, "coords-only", false, "write <name>.crops.json with normalized crop rects per size instead of image files")
+	flag.BoolVar(&o.jsonl, "jsonl", false, "write one JSON line per input to stdout as it completes (source, status, label, outputs)")
+	flag.BoolVar(&o.explain, "explain", false, "print one line per input and size saying why its crop was emitted, skipped or failed")
+
+	flag.BoolVar(&o.formats, "formats", false, "print the supported input and output formats and exit")
 
 	flag.Parse()
-	if in == "" {
-		log.Fatalf("usage: %s -in input.jpg|URL [-backend ollama|llamacpp] [-url server_url] [-out outdir] [-ext jpg|png|webp] [-zoom 0.95] [-sendfmt jpg|png]", filepath.Base(os.Args[0]))
+	if o.formats {
+		fmt.Printf("input:  %s\n", strings.Join(processing.SupportedInputFormats(), ", "))
+		fmt.Printf("output: %s\n", strings.Join(processing.SupportedOutputFormats(), ", "))
+		return
+	}
+	if len(o.inputs) == 0 && o.inputURLs == "" && o.jobs == "" {
+		log.Fatalf("usage: %s -in input.jpg|URL|dir|glob [-in ...] [-input-urls urls.txt] [-backend ollama|llamacpp] [-url server_url] [-out outdir] [-ext jpg|png|webp] [-zoom 0.95] [-sendfmt jpg|png]", filepath.Base(os.Args[0]))
+	}
+	var err error
+	for i, in := range o.inputs {
+		if o.inputs[i], err = expandPath(in); err != nil {
+			log.Fatalf("invalid -in: %v", err)
+		}
+	}
+	if o.inputURLs, err = expandPath(o.inputURLs); err != nil {
+		log.Fatalf("invalid -input-urls: %v", err)
+	}
+	if o.outDir, err = expandPath(o.outDir); err != nil {
+		log.Fatalf("invalid -out: %v", err)
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	targetSizes, err := applyProfile(o.profile, set)
+	if err != nil {
+		log.Fatalf("invalid -profile: %v", err)
+	}
+	if err := validateFlags(o, set); err != nil {
+		log.Fatalf("invalid flags: %v", err)
 	}
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		log.Fatal(err)
+	qualitySet, err := parseQualitySet(o.qualitySetFlag)
+	if err != nil {
+		log.Fatalf("invalid -quality-set: %v", err)
+	}
+	qualities := qualitySet
+	if len(qualities) == 0 {
+		qualities = []int{o.quality}
+	}
+	var inputs []string
+	if o.jobs == "" {
+		if o.inputURLs != "" {
+			urls, err := readURLList(o.inputURLs)
+			if err != nil {
+				log.Fatalf("invalid -input-urls: %v", err)
+			}
+			o.inputs = append(o.inputs, urls...)
+		}
+		inputExts, err := parseInputFormats(o.inputFormat)
+		if err != nil {
+			log.Fatalf("invalid -input-format: %v", err)
+		}
+		if inputs, err = expandInputs(o.inputs); err != nil {
+			log.Fatal(err)
+		}
+		inputs = filterInputFormats(inputs, inputExts)
+		if len(inputs) == 0 {
+			log.Fatalf("no input images matched %v", []string(o.inputs))
+		}
 	}
 
 	// Initialize components
 	processor := processing.NewProcessor()
+	processor.SVGSize = o.svgSize
+	processor.AllowPartial = o.allowPartial
+	processor.AllowThumbnailOnly = o.allowThumbnailOnly
+	processor.HTTPTimeout = o.httpTimeout
+	processor.BlockPrivateNetworks = o.blockPrivate
+	processor.PoolBuffers = o.poolBuffers
+	for _, h := range strings.Split(o.allowHosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			processor.AllowedHosts = append(processor.AllowedHosts, h)
+		}
+	}
+	processor.PNGColorType, _ = processing.ParsePNGColorType(o.pngColor) // checked by validateFlags
+	processor.TagSRGB = o.tagSRGB
 
 	// Create appropriate client based on backend
 	var visionClient client.VisionClient
-	var err error
 
-	switch backend {
+	switch o.backend {
 	case "ollama":
-		if url == "" {
-			url = "http://localhost:11435/api/chat"
+		if o.url == "" {
+			o.url = "http://localhost:11435/api/chat"
 		}
-		visionClient, err = ollama.NewClient(url)
+		oc, err := ollama.NewClientWithTimeout(o.url, o.modelTimeout)
 		if err != nil {
 			log.Fatalf("Failed to create Ollama client: %v", err)
 		}
+		oc.SetMaxConcurrent(o.maxRequests)
+		oc.KeepAlive = o.keepAlive
+		if oc.Options, err = parseOllamaOptions(o.ollamaOpts); err != nil {
+			log.Fatalf("invalid -ollama-opt: %v", err)
+		}
+		visionClient = oc
 	case "llamacpp":
-		if url == "" {
-			url = "http://localhost:8080"
+		if o.url == "" {
+			o.url = "http://localhost:8080"
 		}
-		visionClient, err = llamacpp.NewClient(url)
+		lc, err := llamacpp.NewClientWithTimeout(o.url, o.modelTimeout)
 		if err != nil {
 			log.Fatalf("Failed to create llama.cpp client: %v", err)
 		}
+		lc.SetMaxConcurrent(o.maxRequests)
+		if err := lc.SetChatPath(o.chatPath); err != nil {
+			log.Fatalf("invalid -chat-path: %v", err)
+		}
+		visionClient = lc
 	default:
-		log.Fatalf("Unknown backend: %s (use 'ollama' or 'llamacpp')\n", backend)
+		log.Fatalf("Unknown backend: %s (use 'ollama' or 'llamacpp')\n", o.backend)
+	}
+
+	detector := detection.NewDetectorWithModel(visionClient, o.model)
+	detector.SetCenterTolerance(o.centerTol)
+	if o.labels != "" {
+		detector.SetAllowedLabels(strings.Split(o.labels, ","))
+	}
+	detector.SetLanguage(o.lang)
+
+	var nameTmpl *template.Template
+	if o.nameTemplate != "" {
+		if nameTmpl, err = template.New("name").Option("missingkey=error").Parse(o.nameTemplate); err != nil {
+			log.Fatalf("invalid -name-template: %v", err)
+		}
+	}
+
+	r := &runner{
+		o:           o,
+		processor:   processor,
+		detector:    detector,
+		targetSizes: targetSizes,
+		qualities:   qualities,
+		qualitySet:  len(qualitySet) > 0,
+		nameTmpl:    nameTmpl,
+		budget:      &outputBudget{},
+	}
+	if r.augments, err = parseAugment(o.augment); err != nil {
+		log.Fatalf("invalid -augment: %v", err)
+	}
+	if r.exclude, err = parseExcludeBoxes(o.exclude); err != nil {
+		log.Fatalf("invalid -exclude: %v", err)
+	}
+	if r.extByRatio, err = parseExtByRatio(o.extByRatio); err != nil {
+		log.Fatalf("invalid -ext-by-ratio: %v", err)
+	}
+	if o.maxDecoded > 0 {
+		r.decodeSem = make(chan struct{}, o.maxDecoded)
+	}
+	r.sink = storage.NewDirSink("")
+	if o.output != "" {
+		bucket, prefix, err := storage.ParseS3URL(o.output)
+		if err != nil {
+			log.Fatalf("invalid -output: %v", err)
+		}
+		if r.s3, err = storage.NewS3Sink(storage.S3ConfigFromEnv(bucket, prefix)); err != nil {
+			log.Fatalf("invalid -output: %v", err)
+		}
+		r.sink = r.s3
+	}
+	sample := &types.AnalysisResult{Primary: types.Primary{Label: "subject"}, Tags: []string{"tag"}}
+	if _, err := r.cropFilename("image.jpg", sample, 1, 16, 9, "A", o.quality); err != nil {
+		log.Fatalf("invalid -name-template: %v", err)
+	}
+
+	if o.jobs != "" {
+		in, err := openJobs(o.jobs)
+		if err != nil {
+			log.Fatalf("invalid -jobs: %v", err)
+		}
+		defer in.Close()
+		total, failed, err := r.runJobs(in, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if r.budgetExceeded() {
+			log.Fatalf("stopped: -max-output-size %s reached (%s written)",
+				formatSize(int64(o.maxOutputSize)), formatSize(r.budget.used))
+		}
+		if failed > 0 {
+			log.Fatalf("%d of %d jobs failed", failed, total)
+		}
+		return
 	}
 
-	detector := detection.NewDetector(visionClient)
+	var jsonl io.Writer
+	if o.jsonl {
+		jsonl = os.Stdout
+	}
+	started, failed := r.runInputs(inputs, jsonl)
+	if r.budgetExceeded() {
+		log.Fatalf("stopped: -max-output-size %s reached (%s written), %d of %d inputs not processed",
+			formatSize(int64(o.maxOutputSize)), formatSize(r.budget.used), len(inputs)-started, len(inputs))
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d inputs failed", failed, len(inputs))
+	}
+}
+
+// runInputs processes inputs up to -concurrency at a time, each in its own output directory
+// when several are given, and writes one fileReport line per input to jsonl (if not nil) as it
+// completes. A failing input is logged and counted without stopping the others. It returns how
+// many inputs were started and how many failed.
+func (r *runner) runInputs(inputs []string, jsonl io.Writer) (started, failed int) {
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		enc *json.Encoder
+	)
+	if jsonl != nil {
+		enc = json.NewEncoder(jsonl)
+	}
+	// -max-output-size cancels the batch context: inputs not yet started are skipped
+	batchCtx, stopBatch := context.WithCancel(context.Background())
+	defer stopBatch()
+	r.stopBatch = stopBatch
+	sem := make(chan struct{}, r.o.concurrency)
+	dirs := outputDirs(inputs, r.o.outDir)
+	for i, source := range inputs {
+		sem <- struct{}{}
+		if batchCtx.Err() != nil {
+			<-sem
+			break
+		}
+		started++
+		wg.Add(1)
+		go func(source, dir string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			rep, err := r.runInput(batchCtx, source, dir)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+			}
+			if enc != nil {
+				if err := enc.Encode(rep); err != nil {
+					log.Printf("jsonl: %v", err)
+				}
+			}
+		}(source, dirs[i])
+	}
+	wg.Wait()
+	return started, failed
+}
 
-	// Load input image (from file or URL)
-	img, err := processor.LoadImageSmart(in)
+// runInput processes one input under -file-timeout and returns its report; the error is nil
+// when the input succeeded, was skipped or was stopped by -max-output-size
+func (r *runner) runInput(batchCtx context.Context, source, dir string) (*fileReport, error) {
+	ctx, cancel := batchCtx, context.CancelFunc(func() {})
+	if r.o.fileTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, r.o.fileTimeout)
+	}
+	defer cancel()
+	rep := &fileReport{Source: source, Status: "ok"}
+	err := r.processFile(ctx, source, dir, rep)
+	if errors.Is(err, processing.ErrEmptyFile) {
+		// Typically an interrupted download; not worth failing the batch over
+		rep.Status = "skipped"
+		rep.Error = err.Error()
+		log.Printf("%s: skipped: %v", source, err)
+		return rep, nil
+	}
+	if errors.Is(err, errOutputBudget) || errors.Is(err, context.Canceled) {
+		// Cut short by -max-output-size (the budget refused a write or canceled the batch),
+		// which main reports once for the whole batch
+		rep.Status = "stopped"
+		rep.Error = fmt.Sprintf("stopped by -max-output-size: %v", err)
+		log.Printf("%s: %s", source, rep.Error)
+		return rep, nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		rep.Status = "failed"
+		if ctx.Err() == context.DeadlineExceeded {
+			rep.Status = "timeout"
+			err = fmt.Errorf("timed out after %s: %v", r.o.fileTimeout, err)
+		}
+		rep.Error = err.Error()
+		log.Printf("%s: %v", source, err)
+	}
+	return rep, err
+}
+
+// runner holds the components and settings shared by every processed input
+type runner struct {
+	o           options
+	processor   *processing.Processor
+	detector    *detection.Detector
+	targetSizes [][2]int
+	qualities   []int
+	qualitySet  bool // qualities came from -quality-set, so filenames carry the quality
+	nameTmpl    *template.Template
+	augments    []string           // -augment variants, in flag order
+	exclude     []types.Box        // -exclude regions crops avoid
+	extByRatio  map[string]string  // -ext-by-ratio output formats by reduced W:H
+	decodeSem   chan struct{}      // bounds simultaneously decoded images (-max-decoded), nil = unlimited
+	stopBatch   context.CancelFunc // cancels the batch once -max-output-size is reached
+	budget      *outputBudget      // -max-output-size accounting, shared with -jobs copies
+	sink        storage.OutputSink // where writeOutput stores files
+	s3          *storage.S3Sink    // -output destination, nil = local files
+}
+
+// acquireDecode waits for a decoded-image slot and returns the func releasing it
+func (r *runner) acquireDecode(ctx context.Context) (func(), error) {
+	if r.decodeSem == nil {
+		return func() {}, nil
+	}
+	select {
+	case r.decodeSem <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-r.decodeSem }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// faceLabels and personLabels select portrait framing for -anchor portrait
+var (
+	faceLabels   = []string{"face", "head", "portrait", "selfie"}
+	personLabels = []string{"person", "people", "man", "woman", "boy", "girl", "child", "kid", "baby", "player"}
+)
+
+// labelHasWord reports whether label contains one of the words
+func labelHasWord(label string, words []string) bool {
+	for _, f := range strings.FieldsFunc(strings.ToLower(label), func(c rune) bool { return !unicode.IsLetter(c) }) {
+		for _, w := range words {
+			if f == w || f == w+"s" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cropBox places a crop of w x h: centered on (cx, cy), or with -anchor on the subject box center
+func (r *runner) cropBox(subject types.Primary, cx, cy float64, w, h, imgW, imgH int) types.Box {
+	var box types.Box
+	switch anchor := types.CropAnchor(r.o.anchor); {
+	case anchor == types.AnchorPortrait && labelHasWord(subject.Label, faceLabels):
+		box = r.processor.CalculatePortraitCropBox(subject.Box, w, h, imgW, imgH, r.o.zoom, r.o.headroom)
+	case anchor == types.AnchorPortrait && labelHasWord(subject.Label, personLabels):
+		box = r.processor.CalculatePortraitCropBox(processing.EstimateHeadBox(subject.Box), w, h, imgW, imgH, r.o.zoom, r.o.headroom)
+	case anchor == types.AnchorCenter, anchor == types.AnchorPortrait:
+		// Portrait framing needs a face or person; anything else is centered
+		box = r.processor.CalculateOptimalCropBox(cx, cy, w, h, imgW, imgH, r.o.zoom)
+	default:
+		box = r.processor.CalculateAnchoredCropBox(subject.Box.X+subject.Box.W/2, subject.Box.Y+subject.Box.H/2, w, h, imgW, imgH, r.o.zoom, anchor)
+	}
+	return r.processor.AvoidRegions(box, subject.Box, r.exclude)
+}
+
+// checkOutputFormat reports whether this build can write the named output format
+func checkOutputFormat(format string) error {
+	available := processing.SupportedOutputFormats()
+	format = strings.ToLower(format)
+	if format == "jpeg" || slices.Contains(available, format) {
+		return nil
+	}
+	if format == "avif" {
+		return processing.ErrAVIFUnavailable
+	}
+	return fmt.Errorf("%q is not one of %s", format, strings.Join(available, "|"))
+}
+
+// parseExtByRatio parses -ext-by-ratio values of the form W:H=format (e.g. 1:1=webp,9:16=jpg)
+// into output formats keyed by the reduced ratio
+func parseExtByRatio(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	formats := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		ratio, format, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not W:H=format", pair)
+		}
+		ws, hs, ok := strings.Cut(ratio, ":")
+		w, errW := strconv.Atoi(strings.TrimSpace(ws))
+		h, errH := strconv.Atoi(strings.TrimSpace(hs))
+		if !ok || errW != nil || errH != nil || w <= 0 || h <= 0 {
+			return nil, fmt.Errorf("%q: ratio must be W:H with positive integers", pair)
+		}
+		format = strings.ToLower(strings.TrimSpace(format))
+		if err := checkOutputFormat(format); err != nil {
+			return nil, fmt.Errorf("%q: %v", pair, err)
+		}
+		formats[ratioKey(w, h)] = format
+	}
+	return formats, nil
+}
+
+// ratioKey is the reduced W:H form of a size, e.g. 1200x630 -> 40:21
+func ratioKey(w, h int) string {
+	g := gcd(w, h)
+	return fmt.Sprintf("%d:%d", w/g, h/g)
+}
+
+// cropExt is the output format for a crop of w x h: its -ext-by-ratio entry, else -ext
+func (r *runner) cropExt(w, h int) string {
+	if ext, ok := r.extByRatio[ratioKey(w, h)]; ok {
+		return ext
+	}
+	return strings.ToLower(r.o.ext)
+}
+
+// parseExcludeBoxes parses -exclude values of the form x,y,w,h (normalized)
+func parseExcludeBoxes(values []string) ([]types.Box, error) {
+	var boxes []types.Box
+	for _, v := range values {
+		parts := strings.Split(v, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("%q is not x,y,w,h", v)
+		}
+		var f [4]float64
+		for i, part := range parts {
+			n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil || n < 0 || n > 1 {
+				return nil, fmt.Errorf("%q: values must be numbers in [0,1]", v)
+			}
+			f[i] = n
+		}
+		if f[2] == 0 || f[3] == 0 || f[0]+f[2] > 1 || f[1]+f[3] > 1 {
+			return nil, fmt.Errorf("%q: box must be non-empty and inside the image", v)
+		}
+		boxes = append(boxes, types.Box{X: f[0], Y: f[1], W: f[2], H: f[3]})
+	}
+	return boxes, nil
+}
+
+// outputBudget is the -max-output-size accounting shared by every input
+type outputBudget struct {
+	mu   sync.Mutex
+	used int64 // bytes written
+	over bool
+}
+
+// errOutputBudget is returned for writes refused by -max-output-size
+var errOutputBudget = errors.New("output size budget exceeded")
+
+// saveImage encodes and writes one output image (see writeOutput)
+func (r *runner) saveImage(ctx context.Context, img image.Image, path, format string, quality int, lossless bool) error {
+	data, err := r.processor.EncodeImage(img, format, quality, lossless)
+	if err != nil {
+		return err
+	}
+	return r.writeOutput(ctx, path, data, processing.ContentTypeForFormat(format))
+}
+
+// writeOutput stores one output file through the sink; a file that would take the total past
+// -max-output-size is not written and stops the batch, files already written are left in place
+func (r *runner) writeOutput(ctx context.Context, path string, data []byte, contentType string) error {
+	key, err := r.outputKey(path)
+	if err != nil {
+		return err
+	}
+	limit := int64(r.o.maxOutputSize)
+	if limit > 0 {
+		b := r.budget
+		b.mu.Lock()
+		if b.over || b.used+int64(len(data)) > limit {
+			b.over = true
+			b.mu.Unlock()
+			r.stopBatch()
+			return fmt.Errorf("%w: %s would exceed %s", errOutputBudget, path, formatSize(limit))
+		}
+		b.used += int64(len(data))
+		b.mu.Unlock()
+	}
+	if err := r.sink.Put(ctx, key, data, contentType); err != nil {
+		// Only files actually stored count against the budget
+		if limit > 0 {
+			r.budget.mu.Lock()
+			r.budget.used -= int64(len(data))
+			r.budget.mu.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+// outputKey returns the sink key for an output path: the path itself for local files, the
+// path relative to -out for -output
+func (r *runner) outputKey(path string) (string, error) {
+	if r.s3 == nil {
+		return filepath.ToSlash(path), nil
+	}
+	rel, err := filepath.Rel(r.o.outDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside -out %s, so it has no -output key", path, r.o.outDir)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// outputRef names an output in logs and reports: its path, or its s3:// URL with -output
+func (r *runner) outputRef(path string) string {
+	if r.s3 == nil {
+		return path
+	}
+	key, err := r.outputKey(path)
+	if err != nil {
+		return path
+	}
+	return r.s3.URL(key)
+}
+
+// sourceModTime returns the input file's modification time for -preserve-mtime; it is zero
+// when the flag is off, for URL inputs, or when the file cannot be stat'ed
+func (r *runner) sourceModTime(source string) time.Time {
+	if !r.o.preserveMtime || isURL(source) {
+		return time.Time{}
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		log.Printf("%s: cannot read modification time: %v", source, err)
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// keepModTime sets an output's modification time to mtime, leaving its access time alone;
+// a zero mtime does nothing
+func keepModTime(path string, mtime time.Time) {
+	if mtime.IsZero() {
+		return
+	}
+	if err := os.Chtimes(path, time.Time{}, mtime); err != nil {
+		log.Printf("set modification time of %s failed: %v", path, err)
+	}
+}
+
+// budgetExceeded reports whether -max-output-size stopped the batch
+func (r *runner) budgetExceeded() bool {
+	r.budget.mu.Lock()
+	defer r.budget.mu.Unlock()
+	return r.budget.over
+}
+
+// loadInput decodes one input and applies -deskew, returning the applied rotation
+func (r *runner) loadInput(source string) (image.Image, float64, error) {
+	img, err := r.processor.LoadImageSmart(source)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.o.deskew <= 0 {
+		return img, 0, nil
+	}
+	img, angle := r.processor.Deskew(img, r.o.deskew)
+	return img, angle, nil
+}
+
+// unsafeFilenameChars are replaced in names rendered from -name-template
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// filenameWord makes a label or tag safe for filenames: lowercase, runs of other characters as "_"
+func filenameWord(s string) string {
+	return strings.Trim(unsafeFilenameChars.ReplaceAllString(strings.ToLower(s), "_"), "._")
+}
+
+// subjectWords returns the detected label (unless "none") and the first tag that differs from it
+func subjectWords(result *types.AnalysisResult) (label, tag string) {
+	if result == nil {
+		return "", ""
+	}
+	if !strings.EqualFold(result.Primary.Label, "none") {
+		label = filenameWord(result.Primary.Label)
+	}
+	for _, t := range result.Tags {
+		if t = filenameWord(t); t != "" && t != label {
+			return label, t
+		}
+	}
+	return label, ""
+}
+
+// cropFilename names one crop file, from -name-template when set
+func (r *runner) cropFilename(source string, result *types.AnalysisResult, index, w, h int, variant string, quality int) (string, error) {
+	ext := r.cropExt(w, h)
+	label, tag := subjectWords(result)
+	if r.nameTmpl == nil {
+		suffix := ""
+		if r.qualitySet {
+			suffix = fmt.Sprintf("_q%d", quality)
+		}
+		words := ""
+		if r.o.tagFilenames {
+			for _, word := range []string{label, tag} {
+				if word != "" {
+					words += "_" + word
+				}
+			}
+		}
+		return fmt.Sprintf("%03d%s_%dx%d_%s%s.%s", index, words, w, h, variant, suffix, ext), nil
+	}
+
+	g := gcd(w, h)
+	var buf strings.Builder
+	err := r.nameTmpl.Execute(&buf, map[string]interface{}{
+		"name":    inputStem(source),
+		"index":   fmt.Sprintf("%03d", index),
+		"w":       w,
+		"h":       h,
+		"ratio":   fmt.Sprintf("%dx%d", w/g, h/g),
+		"variant": variant,
+		"quality": quality,
+		"ext":     ext,
+		"label":   label,
+		"tag":     tag,
+	})
+	if err != nil {
+		return "", err
+	}
+	name := strings.Trim(unsafeFilenameChars.ReplaceAllString(buf.String(), "_"), "._")
+	if name == "" {
+		return "", fmt.Errorf("-name-template rendered an empty filename")
+	}
+	return name, nil
+}
+
+// gcd returns the greatest common divisor of two positive integers
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// processFile loads one input, detects its subject and writes crops into outDir
+func (r *runner) processFile(ctx context.Context, source, outDir string, rep *fileReport) error {
+	o, processor := r.o, r.processor
+	if r.s3 == nil {
+		if err := os.MkdirAll(outDir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	// Load input image (from file or URL) once a decode slot is free
+	release, err := r.acquireDecode(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { release() }()
+	img, angle, err := r.loadInput(source)
+	if err != nil {
+		return err
+	}
+	if angle != 0 {
+		log.Printf("deskewed by %.1f degrees", angle)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 	bounds := img.Bounds()
 	imgW, imgH := bounds.Dx(), bounds.Dy()
+	srcTime := r.sourceModTime(source)
+
+	// Thumbnails only need a resize, so skip subject detection entirely
+	if o.thumbnail > 0 {
+		thumb := processor.Thumbnail(img, o.thumbnail)
+		thumbPath := filepath.Join(outDir, fmt.Sprintf("thumbnail_%d.%s", o.thumbnail, strings.ToLower(o.ext)))
+		lossless := o.lossless || (o.autoLossless && processor.PreferLossless(thumb))
+		if err := r.saveImage(ctx, thumb, thumbPath, o.ext, o.quality, lossless); err != nil {
+			return fmt.Errorf("save %s failed: %w", thumbPath, err)
+		}
+		log.Printf("wrote %s (%dx%d)", r.outputRef(thumbPath), thumb.Bounds().Dx(), thumb.Bounds().Dy())
+		keepModTime(thumbPath, srcTime)
+		rep.Outputs = append(rep.Outputs, r.outputRef(thumbPath))
+		return nil
+	}
 
-	// Prepare image for model
-	imgB64, err := processor.PrepareImageForModel(img, sendFmt, sendSize, sendQ)
+	// Prepare image for model; contrast enhancement only affects what the model sees and runs
+	// on the -sendsize copy, so its cost does not grow with the input resolution
+	modelImg := img
+	if o.clahe > 0 {
+		modelImg = processor.CLAHE(processor.Thumbnail(img, o.sendSize), o.clahe, claheTiles)
+	}
+	imgB64, err := processor.PrepareImageForModel(modelImg, o.sendFmt, o.sendSize, o.sendQ)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	// With -max-decoded, free the slot while waiting on the model; local files are
+	// decoded again afterwards, URLs are kept to avoid a second download
+	reload := r.decodeSem != nil && !isURL(source)
+	if reload {
+		img, modelImg = nil, nil
+		release()
 	}
 
 	// Detect subject in image
-	result, err := detector.DetectSubject(context.Background(), model, imgB64)
+	result, err := r.detector.DetectSubjectDefault(ctx, imgB64)
 	if err != nil {
-		log.Fatal(err)
+		// Backends report a canceled or expired request in their own words
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("%w: %v", ctxErr, err)
+		}
+		return err
 	}
+	result = detection.RepairResult(result, imgW, imgH)
+	rep.Label, rep.Confidence = result.Primary.Label, result.Primary.Confidence
 
 	// Find the nearest point to center within the detected box
 	cx, cy := processor.FindNearestPointToCenter(result.Primary.Box)
@@ -131,20 +1007,67 @@ func main() {
 	log.Printf("description: %s", result.Description)
 	log.Printf("tags: %v", result.Tags)
 
+	if o.coordsOnly {
+		return r.writeCoords(ctx, source, outDir, result.Primary, cx, cy, imgW, imgH, rep)
+	}
+
+	if reload {
+		if release, err = r.acquireDecode(ctx); err != nil {
+			return err
+		}
+		if img, _, err = r.loadInput(source); err != nil {
+			return err
+		}
+	}
+
+	// Name the subject's dominant color as an extra tag in model_output.json
+	if o.colorTag && result.Primary.Label != "none" {
+		name := processor.DominantColorName(img, result.Primary.Box)
+		if !slices.Contains(result.Tags, name) {
+			result.Tags = append(result.Tags, name)
+		}
+		log.Printf("subject color: %s", name)
+	}
+	if o.theme {
+		theme := processor.ComputeTheme(img)
+		result.Theme = &theme
+		log.Printf("theme: %s %s %s", theme.Average, theme.Tone, theme.Mood)
+	}
+
 	// Create debug overlay for original image (if debug enabled)
-	if debug {
+	if o.debug {
 		baseOverlay := processor.CreateDebugOverlay(img, result.Primary.Box, types.Box{X: 0, Y: 0, W: 0, H: 0}, cx, cy)
-		baseDbgPath := filepath.Join(outDir, fmt.Sprintf("000_original_with_box.%s", strings.ToLower(dbgext)))
-		if err := processor.SaveImage(baseOverlay, baseDbgPath, dbgext, dbgquality, dbglossless); err != nil {
+		baseDbgPath := filepath.Join(outDir, fmt.Sprintf("000_original_with_box.%s", strings.ToLower(o.dbgext)))
+		if err := r.saveImage(ctx, baseOverlay, baseDbgPath, o.dbgext, o.dbgquality, o.dbglossless); err != nil {
 			log.Printf("debug overlay save failed: %v", err)
 		} else {
-			log.Printf("wrote %s", baseDbgPath)
+			log.Printf("wrote %s", r.outputRef(baseDbgPath))
+		}
+		processor.Release(baseOverlay)
+	}
+
+	// explain reports the outcome for one target size on stdout (with -explain)
+	explain := func(key, variant, format string, args ...interface{}) {
+		if o.explain {
+			fmt.Printf("%s %s_%s: %s\n", source, key, variant, fmt.Sprintf(format, args...))
 		}
 	}
 
 	// Process each target size
+	type keptCrop struct {
+		key   string
+		ratio float64
+		hash  uint64
+	}
+	var kept []keptCrop
+	atlasCrops := map[string]image.Image{}
+	annotations := map[string]image.Rectangle{}
 	seen := map[string]int{}
-	for i, sz := range defaultTargetSizes {
+	for i, sz := range r.targetSizes {
+		// Stop between crops once the per-file deadline (-file-timeout) has passed
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		w, h := sz[0], sz[1]
 		key := fmt.Sprintf("%dx%d", w, h)
 		seen[key]++
@@ -153,36 +1076,429 @@ func main() {
 			variant = "B"
 		}
 
+		_, span := tracer.Start(ctx, "crop", trace.WithAttributes(
+			attribute.Int("image.width", imgW),
+			attribute.Int("image.height", imgH),
+			attribute.Int("crop.width", w),
+			attribute.Int("crop.height", h),
+			attribute.Float64("crop.ratio", float64(w)/float64(h)),
+		))
+
 		// Calculate optimal crop box
-		cropBox := processor.CalculateOptimalCropBox(cx, cy, w, h, imgW, imgH, zoom)
+		cropBox := r.cropBox(result.Primary, cx, cy, w, h, imgW, imgH)
 
 		// Crop and save the image
-		croppedImg, err := processor.CropImageToBox(img, cropBox, w, h)
+		cropCfg := types.CropConfig{
+			Width: w, Height: h, Quality: o.quality, Lossless: o.lossless, Extension: o.ext, PostSharpen: o.sharpen,
+			FullFrameSubjectThreshold: o.fullFrame, Subject: result.Primary.Box, Anchor: types.CropAnchor(o.anchor),
+			Mode: types.CropMode(o.cropMode), MaxCropLoss: o.maxCropLoss,
+		}
+		croppedImg, err := processor.CropImageWithConfig(img, cropBox, cropCfg)
 		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
 			log.Printf("crop %s failed: %v", key, err)
+			explain(key, variant, "failed: %v", err)
 			continue
 		}
+		span.End()
+		if o.grayscale {
+			croppedImg = processor.ToGrayscale(croppedImg)
+		}
 
-		cropPath := filepath.Join(outDir, fmt.Sprintf("%03d_%s_%s.%s", i+1, key, variant, strings.ToLower(ext)))
-		if err := processor.SaveImage(croppedImg, cropPath, ext, quality, lossless); err != nil {
-			log.Printf("save %s failed: %v", cropPath, err)
+		// Skip crops that look the same as one already written
+		if o.dedupe {
+			ratio := float64(w) / float64(h)
+			hash := processor.AverageHash(croppedImg)
+			dup, dist := "", 0
+			for _, k := range kept {
+				d := processing.HashDistance(hash, k.hash)
+				if math.Abs(ratio-k.ratio)/k.ratio <= dedupeRatioTolerance && d <= dedupeHashDistance {
+					dup, dist = k.key, d
+					break
+				}
+			}
+			if dup != "" {
+				log.Printf("skip %s: near-duplicate of %s", key, dup)
+				explain(key, variant, "skipped: near-duplicate of %s (hash distance %d <= %d)", dup, dist, dedupeHashDistance)
+				continue
+			}
+			kept = append(kept, keptCrop{key: key, ratio: ratio, hash: hash})
+		}
+
+		if o.atlas {
+			atlasCrops[fmt.Sprintf("%03d_%s_%s", i+1, key, variant)] = croppedImg
+		}
+		if o.annotate {
+			rect := processing.PixelRect(cropBox, imgW, imgH)
+			if processing.PadsInsteadOfCrop(cropBox, cropCfg) {
+				rect = image.Rect(0, 0, imgW, imgH)
+			}
+			annotations[fmt.Sprintf("%03d %s %s", i+1, key, variant)] = rect.Add(img.Bounds().Min)
+		}
+
+		lossless := o.lossless
+		if o.autoLossless {
+			lossless = processor.PreferLossless(croppedImg)
+		}
+
+		// Mirrored copies requested with -augment are saved next to the crop
+		type cropOutput struct {
+			img    image.Image
+			marker string
+		}
+		outputs := []cropOutput{{croppedImg, ""}}
+		for _, a := range r.augments {
+			outputs = append(outputs, cropOutput{augmentations[a].apply(croppedImg), augmentations[a].marker})
+		}
+
+		// Encode the same crop once per requested quality
+		written := 0
+		var saveErr error
+		for _, q := range r.qualities {
+			name, err := r.cropFilename(source, result, i+1, w, h, variant, q)
+			if err != nil {
+				log.Printf("name %s failed: %v", key, err)
+				saveErr = err
+				continue
+			}
+			for _, out := range outputs {
+				ext := filepath.Ext(name)
+				cropPath := filepath.Join(outDir, strings.TrimSuffix(name, ext)+out.marker+ext)
+				if err := r.saveImage(ctx, out.img, cropPath, r.cropExt(w, h), q, lossless); err != nil {
+					log.Printf("save %s failed: %v", cropPath, err)
+					saveErr = err
+				} else {
+					log.Printf("wrote %s", r.outputRef(cropPath))
+					keepModTime(cropPath, srcTime)
+					rep.Outputs = append(rep.Outputs, r.outputRef(cropPath))
+					written++
+				}
+			}
+		}
+		if written == 0 {
+			explain(key, variant, "failed: %v", saveErr)
 		} else {
-			log.Printf("wrote %s", cropPath)
+			explain(key, variant, "emitted (crop box %.3fx%.3f@%.3f,%.3f, subject coverage %.2f, %d file(s))",
+				cropBox.W, cropBox.H, cropBox.X, cropBox.Y, processing.SubjectCoverage(result.Primary.Box, cropBox), written)
 		}
 
 		// Create debug overlay for this crop (if debug enabled)
-		if debug {
+		if o.debug {
 			dbg := processor.CreateDebugOverlay(img, result.Primary.Box, cropBox, cx, cy)
-			dbgPath := filepath.Join(outDir, fmt.Sprintf("%03d_debug_%s_%s.%s", i+1, key, variant, strings.ToLower(dbgext)))
-			if err := processor.SaveImage(dbg, dbgPath, dbgext, dbgquality, dbglossless); err != nil {
+			dbgPath := filepath.Join(outDir, fmt.Sprintf("%03d_debug_%s_%s.%s", i+1, key, variant, strings.ToLower(o.dbgext)))
+			if err := r.saveImage(ctx, dbg, dbgPath, o.dbgext, o.dbgquality, o.dbglossless); err != nil {
 				log.Printf("debug save %s failed: %v", dbgPath, err)
 			} else {
-				log.Printf("wrote %s", dbgPath)
+				log.Printf("wrote %s", r.outputRef(dbgPath))
 			}
+			processor.Release(dbg)
 		}
 	}
 
+	if o.atlas && len(atlasCrops) > 0 {
+		if err := r.writeAtlas(ctx, atlasCrops, outDir); err != nil {
+			log.Printf("atlas failed: %v", err)
+		}
+	}
+
+	// One review image with every emitted crop rectangle drawn on the original
+	if o.annotate && len(annotations) > 0 {
+		annotated := processor.CreateMultiCropOverlay(img, annotations)
+		annotatedPath := filepath.Join(outDir, fmt.Sprintf("000_annotated.%s", strings.ToLower(o.dbgext)))
+		if err := r.saveImage(ctx, annotated, annotatedPath, o.dbgext, o.dbgquality, o.dbglossless); err != nil {
+			log.Printf("annotated image save failed: %v", err)
+		} else {
+			log.Printf("wrote %s", r.outputRef(annotatedPath))
+			rep.Outputs = append(rep.Outputs, r.outputRef(annotatedPath))
+		}
+		processor.Release(annotated)
+	}
+
 	// Save raw model JSON output
 	js, _ := json.MarshalIndent(result, "", "  ")
-	_ = os.WriteFile(filepath.Join(outDir, "model_output.json"), js, 0o644)
+	return r.writeOutput(ctx, filepath.Join(outDir, "model_output.json"), js, "application/json")
+}
+
+// writeCoords writes the normalized crop rect of every target size to <name>.crops.json
+func (r *runner) writeCoords(ctx context.Context, source, outDir string, subject types.Primary, cx, cy float64, imgW, imgH int, rep *fileReport) error {
+	o := r.o
+	crops := make(map[string]cropCoords, len(r.targetSizes))
+	seen := map[string]int{}
+	for i, sz := range r.targetSizes {
+		w, h := sz[0], sz[1]
+		key := fmt.Sprintf("%dx%d", w, h)
+		seen[key]++
+		variant := "A"
+		if seen[key] > 1 {
+			variant = "B"
+		}
+		c := cropCoords{Width: w, Height: h, Box: r.cropBox(subject, cx, cy, w, h, imgW, imgH)}
+		cfg := types.CropConfig{
+			Width: w, Height: h, FullFrameSubjectThreshold: o.fullFrame, Subject: subject.Box,
+			Mode: types.CropMode(o.cropMode), MaxCropLoss: o.maxCropLoss,
+		}
+		if processing.PadsInsteadOfCrop(c.Box, cfg) {
+			c.Padded = true
+			c.Box = types.Box{X: 0, Y: 0, W: 1, H: 1}
+		}
+		rect := processing.PixelRect(c.Box, imgW, imgH)
+		c.SourceRect = pixelRect{X: rect.Min.X, Y: rect.Min.Y, W: rect.Dx(), H: rect.Dy()}
+		c.SubjectCoverage = processing.SubjectCoverage(subject.Box, c.Box)
+		crops[fmt.Sprintf("%03d_%s_%s", i+1, key, variant)] = c
+	}
+
+	js, _ := json.MarshalIndent(map[string]interface{}{
+		"source": source,
+		"width":  imgW,
+		"height": imgH,
+		"crops":  crops,
+	}, "", "  ")
+	jsonPath := filepath.Join(outDir, inputStem(source)+".crops.json")
+	if err := r.writeOutput(ctx, jsonPath, js, "application/json"); err != nil {
+		return err
+	}
+	log.Printf("wrote %s", r.outputRef(jsonPath))
+	rep.Outputs = append(rep.Outputs, r.outputRef(jsonPath))
+	return nil
+}
+
+// writeAtlas packs the crops into one image and writes it alongside a JSON map of name -> rect
+func (r *runner) writeAtlas(ctx context.Context, crops map[string]image.Image, outDir string) error {
+	o := r.o
+	atlas, rects, err := r.processor.PackAtlas(crops, atlasMaxWidth)
+	if err != nil {
+		return err
+	}
+	atlasPath := filepath.Join(outDir, fmt.Sprintf("atlas.%s", strings.ToLower(o.ext)))
+	if err := r.saveImage(ctx, atlas, atlasPath, o.ext, o.quality, o.lossless); err != nil {
+		return err
+	}
+	log.Printf("wrote %s", r.outputRef(atlasPath))
+
+	entries := make(map[string]atlasEntry, len(rects))
+	for name, rect := range rects {
+		entries[name] = atlasEntry{X: rect.Min.X, Y: rect.Min.Y, W: rect.Dx(), H: rect.Dy()}
+	}
+	js, _ := json.MarshalIndent(entries, "", "  ")
+	jsonPath := filepath.Join(outDir, "atlas.json")
+	if err := r.writeOutput(ctx, jsonPath, js, "application/json"); err != nil {
+		return err
+	}
+	log.Printf("wrote %s", r.outputRef(jsonPath))
+	return nil
+}
+
+// applyProfile sets the named profile's flags that were not given explicitly
+// and returns the target sizes to crop to
+func applyProfile(name string, set map[string]bool) ([][2]int, error) {
+	if name == "" {
+		return defaultTargetSizes, nil
+	}
+	prof, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	for k, v := range prof.flags {
+		if set[k] {
+			continue
+		}
+		if err := flag.Set(k, v); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+	if prof.sizes == nil {
+		return defaultTargetSizes, nil
+	}
+	return prof.sizes, nil
+}
+
+// validateFlags rejects flag combinations that would otherwise silently do something surprising.
+// set holds the names of flags given explicitly on the command line.
+func validateFlags(o options, set map[string]bool) error {
+	for _, f := range [][2]string{{"ext", o.ext}, {"dbgext", o.dbgext}} {
+		if err := checkOutputFormat(f[1]); err != nil {
+			return fmt.Errorf("-%s: %v", f[0], err)
+		}
+	}
+	if _, err := processing.ParsePNGColorType(o.pngColor); err != nil {
+		return fmt.Errorf("-png-color: %v", err)
+	}
+	if s := strings.ToLower(o.sendFmt); s != "jpg" && s != "jpeg" && s != "png" {
+		return fmt.Errorf("-sendfmt %q is not one of jpg|png", o.sendFmt)
+	}
+	if o.deskew < 0 || o.deskew > 45 {
+		return fmt.Errorf("-deskew must be between 0 and 45 degrees")
+	}
+	switch types.CropAnchor(o.anchor) {
+	case types.AnchorCenter, types.AnchorThirds, types.AnchorGolden, types.AnchorPortrait:
+	default:
+		return fmt.Errorf("-anchor %q is not one of center|thirds|golden|portrait", o.anchor)
+	}
+	switch types.CropMode(o.cropMode) {
+	case types.CropModeCrop, types.CropModePad, types.CropModeAuto:
+	default:
+		return fmt.Errorf("-crop-mode %q is not one of crop|pad|auto", o.cropMode)
+	}
+	if o.maxCropLoss <= 0 || o.maxCropLoss > 1 {
+		return fmt.Errorf("-max-crop-loss must be in (0, 1]")
+	}
+	if set["max-crop-loss"] && o.cropMode != string(types.CropModeAuto) {
+		return fmt.Errorf("-max-crop-loss only applies to -crop-mode auto")
+	}
+	if o.headroom < 0 || o.headroom > 0.5 {
+		return fmt.Errorf("-headroom must be between 0 and 0.5")
+	}
+	if set["headroom"] && o.anchor != string(types.AnchorPortrait) {
+		return fmt.Errorf("-headroom only applies to -anchor portrait")
+	}
+	if o.clahe < 0 {
+		return fmt.Errorf("-clahe must not be negative")
+	}
+	if o.fullFrame < 0 || o.fullFrame > 1 {
+		return fmt.Errorf("-full-frame must be between 0 and 1")
+	}
+	if o.fullFrame > 0 && o.cropMode == string(types.CropModePad) {
+		return fmt.Errorf("-full-frame has no effect with -crop-mode pad, which always keeps the full frame")
+	}
+	if o.thumbnail < 0 {
+		return fmt.Errorf("-thumbnail must not be negative")
+	}
+	if o.sharpen < 0 {
+		return fmt.Errorf("-sharpen must not be negative")
+	}
+	if o.concurrency < 1 {
+		return fmt.Errorf("-concurrency must be at least 1")
+	}
+	if o.backend != "ollama" && (len(o.ollamaOpts) > 0 || o.keepAlive != 0) {
+		return fmt.Errorf("-ollama-opt and -keep-alive require -backend ollama")
+	}
+	if o.backend != "llamacpp" && set["chat-path"] {
+		return fmt.Errorf("-chat-path requires -backend llamacpp")
+	}
+	if o.fileTimeout < 0 {
+		return fmt.Errorf("-file-timeout must not be negative")
+	}
+	if o.modelTimeout < 0 {
+		return fmt.Errorf("-model-timeout must not be negative")
+	}
+	if o.maxDecoded < 0 {
+		return fmt.Errorf("-max-decoded must not be negative")
+	}
+	if o.maxRequests < 0 {
+		return fmt.Errorf("-max-requests must not be negative")
+	}
+	if o.httpTimeout <= 0 {
+		return fmt.Errorf("-http-timeout must be positive")
+	}
+	if o.lossless && strings.ToLower(o.ext) != "webp" {
+		return fmt.Errorf("-lossless only applies to -ext webp")
+	}
+	if o.autoLossless {
+		if strings.ToLower(o.ext) != "webp" {
+			return fmt.Errorf("-auto-lossless only applies to -ext webp")
+		}
+		if o.lossless {
+			return fmt.Errorf("-lossless and -auto-lossless are mutually exclusive")
+		}
+	}
+	if o.dbglossless && strings.ToLower(o.dbgext) != "webp" {
+		return fmt.Errorf("-dbglossless only applies to -dbgext webp")
+	}
+	if o.qualitySetFlag != "" {
+		if set["quality"] {
+			return fmt.Errorf("-quality and -quality-set are mutually exclusive")
+		}
+		if strings.ToLower(o.ext) == "png" || o.lossless {
+			return fmt.Errorf("-quality-set has no effect with png or lossless output")
+		}
+	}
+	if o.tagFilenames && o.nameTemplate != "" {
+		return fmt.Errorf("-tag-filenames does not apply to -name-template; use {{.label}} and {{.tag}} instead")
+	}
+	if o.jobs != "" {
+		// Jobs bring their own inputs and the result lines take stdout
+		for _, name := range []string{"in", "input-urls", "input-format", "jsonl", "explain"} {
+			if set[name] {
+				return fmt.Errorf("-%s cannot be combined with -jobs", name)
+			}
+		}
+	}
+	if o.output != "" && set["preserve-mtime"] {
+		return fmt.Errorf("-preserve-mtime needs local files and cannot be combined with -output")
+	}
+	if o.jsonl && o.explain {
+		return fmt.Errorf("-jsonl and -explain both write to stdout and cannot be combined")
+	}
+	if o.coordsOnly {
+		// No crops are rendered, so pixel-level options would be ignored
+		for _, name := range []string{"thumbnail", "augment", "quality-set", "dedupe-crops", "debug", "sharpen", "atlas", "grayscale", "explain", "color-tag", "tag-filenames", "theme", "ext-by-ratio", "annotate", "preserve-mtime", "tag-srgb"} {
+			if set[name] {
+				return fmt.Errorf("-%s cannot be combined with -coords-only", name)
+			}
+		}
+	}
+	if o.thumbnail > 0 {
+		// Thumbnails skip detection and cropping, so crop-only flags would be ignored
+		for _, name := range []string{"quality-set", "dedupe-crops", "debug", "sharpen", "zoom", "center-tol", "atlas", "grayscale", "explain", "labels", "full-frame", "clahe", "anchor", "headroom", "augment", "exclude", "color-tag", "tag-filenames", "lang", "crop-mode", "max-crop-loss", "theme", "ext-by-ratio", "annotate"} {
+			if set[name] {
+				return fmt.Errorf("-%s cannot be combined with -thumbnail", name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseOllamaOptions parses key=value pairs, typing values as int, float, bool or string
+func parseOllamaOptions(pairs []string) (map[string]any, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	opts := make(map[string]any, len(pairs))
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%q is not key=value", pair)
+		}
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			opts[k] = i
+		} else if f, err := strconv.ParseFloat(v, 64); err == nil {
+			opts[k] = f
+		} else if b, err := strconv.ParseBool(v); err == nil {
+			opts[k] = b
+		} else {
+			opts[k] = v
+		}
+	}
+	return opts, nil
+}
+
+// parseQualitySet parses a comma-separated list of output qualities (1-100)
+func parseQualitySet(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var out []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		q, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("bad quality %q", part)
+		}
+		if q < 1 || q > 100 {
+			return nil, fmt.Errorf("quality %d out of range 1-100", q)
+		}
+		if !seen[q] {
+			seen[q] = true
+			out = append(out, q)
+		}
+	}
+	return out, nil
 }
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/disintegration/imaging"
+
+	"github.com/menta2k/image-analyzer/pkg/detection"
+	"github.com/menta2k/image-analyzer/pkg/processing"
+	"github.com/menta2k/image-analyzer/pkg/storage"
+	"github.com/menta2k/image-analyzer/pkg/types"
+)
+
+func TestCheckOutputFormat(t *testing.T) {
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{"jpg", false},
+		{"JPEG", false},
+		{"png", false},
+		{"webp", false},
+		{"gif", true},
+		{"", true},
+		// The CLI registers an AVIF encoder only when built with -tags avif
+		{"avif", !processing.AVIFAvailable()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if err := checkOutputFormat(tt.format); (err != nil) != tt.wantErr {
+				t.Errorf("checkOutputFormat(%q) = %v, want error %v", tt.format, err, tt.wantErr)
+			}
+		})
+	}
+	if err := checkOutputFormat("avif"); !processing.AVIFAvailable() && !errors.Is(err, processing.ErrAVIFUnavailable) {
+		t.Errorf("avif: err = %v, want ErrAVIFUnavailable", err)
+	}
+}
+
+func TestParseExtByRatio(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"1:1=webp, 18:32=JPG", map[string]string{"1:1": "webp", "9:16": "jpg"}, false},
+		{"1:1=avif", nil, !processing.AVIFAvailable()},
+		{"1:1", nil, true},
+		{"0:1=png", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseExtByRatio(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr || tt.want == nil {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateFlagsRejects(t *testing.T) {
+	// valid mirrors the flag defaults, which validateFlags accepts
+	valid := func() options {
+		return options{
+			ext: "jpg", dbgext: "png", sendFmt: "jpg", anchor: "center", cropMode: "crop",
+			maxCropLoss: types.DefaultMaxCropLoss, headroom: processing.DefaultHeadroom,
+			concurrency: 1, backend: "llamacpp", httpTimeout: processing.DefaultHTTPTimeout,
+		}
+	}
+	if err := validateFlags(valid(), nil); err != nil {
+		t.Fatalf("defaults rejected: %v", err)
+	}
+	tests := []struct {
+		name string
+		edit func(o *options)
+		set  []string
+	}{
+		{"negative thumbnail", func(o *options) { o.thumbnail = -64 }, []string{"thumbnail"}},
+		{"negative sharpen", func(o *options) { o.sharpen = -0.5 }, []string{"sharpen"}},
+		{"headroom without portrait", func(o *options) { o.headroom = 0.2 }, []string{"headroom"}},
+		{"full-frame with pad", func(o *options) { o.fullFrame = 0.8; o.cropMode = "pad" }, []string{"full-frame", "crop-mode"}},
+		{"max-crop-loss without auto", func(o *options) { o.maxCropLoss = 0.5 }, []string{"max-crop-loss"}},
+		{"lossless and auto-lossless", func(o *options) { o.ext = "webp"; o.lossless = true; o.autoLossless = true }, []string{"ext", "lossless", "auto-lossless"}},
+		{"quality and quality-set", func(o *options) { o.qualitySetFlag = "60,80" }, []string{"quality", "quality-set"}},
+		{"jobs with in", func(o *options) { o.jobs = "jobs.jsonl" }, []string{"jobs", "in"}},
+		{"output with preserve-mtime", func(o *options) { o.output = "s3://bucket/crops"; o.preserveMtime = true }, []string{"output", "preserve-mtime"}},
+		{"jsonl and explain", func(o *options) { o.jsonl = true; o.explain = true }, []string{"jsonl", "explain"}},
+		{"coords-only with sharpen", func(o *options) { o.coordsOnly = true; o.sharpen = 1 }, []string{"coords-only", "sharpen"}},
+		{"thumbnail with anchor", func(o *options) { o.thumbnail = 256; o.anchor = "thirds" }, []string{"thumbnail", "anchor"}},
+		{"chat-path with ollama", func(o *options) { o.backend = "ollama" }, []string{"backend", "chat-path"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := valid()
+			tt.edit(&o)
+			set := map[string]bool{}
+			for _, name := range tt.set {
+				set[name] = true
+			}
+			if err := validateFlags(o, set); err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+// fakeSink records what is stored under each key
+type fakeSink struct {
+	mu    sync.Mutex
+	files map[string]fakeFile
+}
+
+type fakeFile struct {
+	data        []byte
+	contentType string
+}
+
+func (s *fakeSink) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = map[string]fakeFile{}
+	}
+	s.files[key] = fakeFile{data, contentType}
+	return nil
+}
+
+// fakeVision answers every request with the same subject
+type fakeVision struct{}
+
+func (fakeVision) SimpleQuery(ctx context.Context, model, prompt, imgB64 string) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (fakeVision) AnalyzeImage(ctx context.Context, model, prompt, imgB64 string) (*types.AnalysisResult, error) {
+	return &types.AnalysisResult{Primary: types.Primary{
+		Label: "dog", Confidence: 0.9, Box: types.Box{X: 0.3, Y: 0.3, W: 0.4, H: 0.4}, Cx: 0.5, Cy: 0.5,
+	}}, nil
+}
+
+// testRunner returns a runner writing to sink with a fake vision model and the given crop sizes
+func testRunner(t *testing.T, sink *fakeSink, sizes ...[2]int) *runner {
+	t.Helper()
+	o := options{
+		outDir: t.TempDir(), ext: "jpg", quality: 80, dbgext: "png", dbgquality: 80,
+		sendFmt: "jpg", sendSize: 256, sendQ: 80, concurrency: 1,
+	}
+	return &runner{
+		o:           o,
+		processor:   processing.NewProcessor(),
+		detector:    detection.NewDetectorWithModel(fakeVision{}, "test"),
+		targetSizes: sizes,
+		qualities:   []int{o.quality},
+		budget:      &outputBudget{},
+		sink:        sink,
+		stopBatch:   func() {},
+	}
+}
+
+// writeTestPNG writes a w x h PNG input and returns its path
+func writeTestPNG(t *testing.T, w, h int) string {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	return writePNG(t, img)
+}
+
+// writePNG writes img as a PNG input and returns its path
+func writePNG(t *testing.T, img image.Image) string {
+	t.Helper()
+	data, err := processing.NewProcessor().EncodeImage(img, "png", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "in.png")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProcessFileSinkKeys(t *testing.T) {
+	sink := &fakeSink{}
+	r := testRunner(t, sink, [2]int{64, 64}, [2]int{96, 48})
+	r.o.debug = true
+	r.extByRatio = map[string]string{"2:1": "webp"}
+	src := writeTestPNG(t, 200, 150)
+	dir := filepath.Join(r.o.outDir, "in")
+
+	if err := r.processFile(context.Background(), src, dir, &fileReport{}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"000_original_with_box.png": "image/png",
+		"001_64x64_A.jpg":           "image/jpeg",
+		"001_debug_64x64_A.png":     "image/png",
+		"002_96x48_A.webp":          "image/webp",
+		"002_debug_96x48_A.png":     "image/png",
+		"model_output.json":         "application/json",
+	}
+	var got []string
+	for key := range sink.files {
+		got = append(got, key)
+	}
+	sort.Strings(got)
+	if len(got) != len(want) {
+		t.Fatalf("keys = %v, want %d keys", got, len(want))
+	}
+	for name, contentType := range want {
+		f, ok := sink.files[filepath.ToSlash(filepath.Join(dir, name))]
+		if !ok {
+			t.Errorf("no %s among %v", name, got)
+			continue
+		}
+		if f.contentType != contentType {
+			t.Errorf("%s: content type %q, want %q", name, f.contentType, contentType)
+		}
+		// The content type matches the bytes actually stored
+		if sniffed := http.DetectContentType(f.data); contentType != "application/json" && sniffed != contentType {
+			t.Errorf("%s: data sniffs as %q, want %q", name, sniffed, contentType)
+		}
+	}
+}
+
+func TestAVIFOutput(t *testing.T) {
+	if !processing.AVIFAvailable() {
+		t.Skip("no AVIF backend in this build (build with -tags avif)")
+	}
+	sink := &fakeSink{}
+	r := testRunner(t, sink, [2]int{64, 48})
+	r.o.ext = "avif"
+	src := writeTestPNG(t, 200, 150)
+	dir := filepath.Join(r.o.outDir, "in")
+
+	if err := r.processFile(context.Background(), src, dir, &fileReport{}); err != nil {
+		t.Fatal(err)
+	}
+	f, ok := sink.files[filepath.ToSlash(filepath.Join(dir, "001_64x48_A.avif"))]
+	if !ok {
+		t.Fatalf("no avif crop among %d files", len(sink.files))
+	}
+	if f.contentType != "image/avif" {
+		t.Errorf("content type %q, want image/avif", f.contentType)
+	}
+	img, format, err := image.Decode(bytes.NewReader(f.data))
+	if err != nil {
+		t.Fatalf("crop does not decode: %v", err)
+	}
+	if format != "avif" || img.Bounds().Size() != image.Pt(64, 48) {
+		t.Errorf("decoded %s %v, want avif 64x48", format, img.Bounds().Size())
+	}
+}
+
+func TestWriteOutputCanceled(t *testing.T) {
+	r := testRunner(t, nil)
+	r.sink = storage.NewDirSink("")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	path := filepath.Join(r.o.outDir, "a.json")
+	if err := r.writeOutput(ctx, path, []byte("{}"), "application/json"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s was written after cancellation", path)
+	}
+}
+
+// failingSink refuses every write
+type failingSink struct{}
+
+func (failingSink) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return errors.New("disk full")
+}
+
+func TestWriteOutputBudget(t *testing.T) {
+	sink := &fakeSink{}
+	r := testRunner(t, sink)
+	r.o.maxOutputSize = 10
+	stopped := false
+	r.stopBatch = func() { stopped = true }
+
+	// A failed write does not use up the budget
+	r.sink = failingSink{}
+	if err := r.writeOutput(context.Background(), filepath.Join(r.o.outDir, "x"), make([]byte, 8), ""); err == nil {
+		t.Fatal("write to a failing sink succeeded")
+	}
+	r.sink = sink
+	for i, size := range []int{4, 4, 4, 1} {
+		err := r.writeOutput(context.Background(), filepath.Join(r.o.outDir, strconv.Itoa(i)), make([]byte, size), "")
+		if wantErr := i >= 2; wantErr != errors.Is(err, errOutputBudget) {
+			t.Fatalf("write %d: err = %v, want budget error %v", i, err, wantErr)
+		}
+	}
+	if len(sink.files) != 2 || !stopped || r.budget.used != 8 {
+		t.Errorf("%d files stored, %d bytes used, batch stopped %v; want 2, 8, true", len(sink.files), r.budget.used, stopped)
+	}
+}
+
+func TestRunInputStatus(t *testing.T) {
+	src := writeTestPNG(t, 100, 80)
+	tests := []struct {
+		name       string
+		source     string
+		budget     byteSize
+		tripped    bool // the budget was already exceeded by another input
+		wantStatus string
+		wantErr    bool
+	}{
+		{"ok", src, 0, false, "ok", false},
+		{"write refused", src, 10, false, "stopped", false},
+		{"batch stopped", src, 1 << 20, true, "stopped", false},
+		// A failure of its own is not blamed on the budget
+		{"unrelated failure after the budget tripped", filepath.Join(t.TempDir(), "missing.png"), 1 << 20, true, "failed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRunner(t, &fakeSink{})
+			r.o.thumbnail = 32
+			r.o.maxOutputSize = tt.budget
+			batchCtx, stopBatch := context.WithCancel(context.Background())
+			defer stopBatch()
+			r.stopBatch = stopBatch
+			if tt.tripped {
+				r.budget.over = true
+				stopBatch()
+			}
+			rep, err := r.runInput(batchCtx, tt.source, r.o.outDir)
+			if rep.Status != tt.wantStatus || (err != nil) != tt.wantErr {
+				t.Errorf("status %q, err %v; want %q, error %v", rep.Status, err, tt.wantStatus, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessFileThumbnail(t *testing.T) {
+	sink := &fakeSink{}
+	r := testRunner(t, sink, [2]int{64, 64})
+	r.o.thumbnail = 512
+	r.o.ext = "png"
+	rep := &fileReport{}
+	if err := r.processFile(context.Background(), writeTestPNG(t, 2000, 1000), r.o.outDir, rep); err != nil {
+		t.Fatal(err)
+	}
+	// Only the thumbnail is written, no crops or model output
+	key := filepath.ToSlash(filepath.Join(r.o.outDir, "thumbnail_512.png"))
+	f, ok := sink.files[key]
+	if len(sink.files) != 1 || !ok {
+		t.Fatalf("stored %d files, want only %s", len(sink.files), key)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(f.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 512 || cfg.Height != 256 {
+		t.Errorf("thumbnail is %dx%d, want 512x256", cfg.Width, cfg.Height)
+	}
+}
+
+func TestLoadInputDeskew(t *testing.T) {
+	board := image.NewGray(image.Rect(0, 0, 600, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 600; x++ {
+			if (x/40+y/40)%2 == 0 {
+				board.Pix[y*board.Stride+x] = 255
+			}
+		}
+	}
+	src := writePNG(t, imaging.CropCenter(imaging.Rotate(board, 2, color.Gray{128}), 520, 340))
+	tests := []struct {
+		name   string
+		deskew float64
+		want   float64
+	}{
+		{"off", 0, 0},
+		{"on", 5, -2},
+		{"limited", 1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRunner(t, &fakeSink{})
+			r.o.deskew = tt.deskew
+			_, angle, err := r.loadInput(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(angle-tt.want) > 1e-9 {
+				t.Errorf("angle = %.2f, want %.2f", angle, tt.want)
+			}
+		})
+	}
+}
+
+// heldSink holds writes below dir until release is closed
+type heldSink struct {
+	fakeSink
+	dir     string
+	release chan struct{}
+}
+
+func (s *heldSink) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if strings.HasPrefix(key, filepath.ToSlash(s.dir)+"/") {
+		<-s.release
+	}
+	return s.fakeSink.Put(ctx, key, data, contentType)
+}
+
+// lineWriter records what is written and calls after once n lines have been written
+type lineWriter struct {
+	bytes.Buffer
+	n     int
+	after func()
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	if strings.Count(w.String(), "\n") == w.n && w.after != nil {
+		w.after()
+		w.after = nil
+	}
+	return n, err
+}
+
+func TestRunInputsJSONL(t *testing.T) {
+	inputs := []string{
+		writeTestPNG(t, 120, 90),
+		writeTestPNG(t, 100, 80),
+		filepath.Join(t.TempDir(), "missing.png"),
+		writeTestPNG(t, 80, 60),
+	}
+	r := testRunner(t, nil)
+	r.o.thumbnail = 32
+	r.o.concurrency = len(inputs)
+	// The first input cannot finish until every other input has been reported
+	sink := &heldSink{dir: outputDirs(inputs, r.o.outDir)[0], release: make(chan struct{})}
+	r.sink = sink
+	out := &lineWriter{n: len(inputs) - 1, after: func() { close(sink.release) }}
+
+	started, failed := r.runInputs(inputs, out)
+	if started != len(inputs) || failed != 1 {
+		t.Errorf("started %d, failed %d; want %d, 1", started, failed, len(inputs))
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(inputs) {
+		t.Fatalf("%d lines, want %d:\n%s", len(lines), len(inputs), out.String())
+	}
+	seen := map[string]string{}
+	for i, line := range lines {
+		var rep fileReport
+		if err := json.Unmarshal([]byte(line), &rep); err != nil {
+			t.Fatalf("line %d is not a JSON report: %v\n%s", i+1, err, line)
+		}
+		seen[rep.Source] = rep.Status
+		// Lines come in completion order, so the held input is last
+		if i == len(lines)-1 && rep.Source != inputs[0] {
+			t.Errorf("last line is %s, want the held input %s", rep.Source, inputs[0])
+		}
+	}
+	for i, source := range inputs {
+		want := "ok"
+		if i == 2 {
+			want = "failed"
+		}
+		if seen[source] != want {
+			t.Errorf("%s: status %q, want %q", source, seen[source], want)
+		}
+	}
+}
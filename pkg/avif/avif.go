@@ -0,0 +1,196 @@
+//go:build avif
+
+// Package avif encodes and decodes AVIF images through libavif (0.11 or later, found with
+// pkg-config). Importing it registers the "avif" output format with pkg/processing and the
+// AVIF decoder with the image package; it is only built with -tags avif.
+package avif
+
+/*
+#cgo pkg-config: libavif
+#include <stdlib.h>
+#include <avif/avif.h>
+
+// encodeRGBA encodes 8-bit non-premultiplied RGBA pixels into out, which the caller frees
+// with avifRWDataFree. quantizer is 0 (best) to 63 (worst).
+static avifResult encodeRGBA(uint8_t *pix, uint32_t w, uint32_t h, uint32_t stride, int ignoreAlpha,
+		int quantizer, int speed, int threads, avifRWData *out) {
+	avifImage *image = avifImageCreate(w, h, 8, AVIF_PIXEL_FORMAT_YUV420);
+	if (image == NULL) {
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+	avifRGBImage rgb;
+	avifRGBImageSetDefaults(&rgb, image);
+	rgb.format = AVIF_RGB_FORMAT_RGBA;
+	rgb.depth = 8;
+	rgb.ignoreAlpha = ignoreAlpha ? AVIF_TRUE : AVIF_FALSE;
+	rgb.pixels = pix;
+	rgb.rowBytes = stride;
+	avifResult r = avifImageRGBToYUV(image, &rgb);
+	if (r != AVIF_RESULT_OK) {
+		avifImageDestroy(image);
+		return r;
+	}
+	avifEncoder *enc = avifEncoderCreate();
+	if (enc == NULL) {
+		avifImageDestroy(image);
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+	enc->minQuantizer = enc->maxQuantizer = quantizer;
+	enc->minQuantizerAlpha = enc->maxQuantizerAlpha = quantizer;
+	enc->speed = speed;
+	enc->maxThreads = threads;
+	r = avifEncoderWrite(enc, image, out);
+	avifEncoderDestroy(enc);
+	avifImageDestroy(image);
+	return r;
+}
+
+// decodeRGBA decodes the first frame of data into rgb as 8-bit RGBA; on success the caller
+// frees the pixels with avifRGBImageFreePixels
+static avifResult decodeRGBA(const uint8_t *data, size_t size, avifRGBImage *rgb) {
+	avifDecoder *dec = avifDecoderCreate();
+	if (dec == NULL) {
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+	avifResult r = avifDecoderSetIOMemory(dec, data, size);
+	if (r == AVIF_RESULT_OK) {
+		r = avifDecoderParse(dec);
+	}
+	if (r == AVIF_RESULT_OK) {
+		r = avifDecoderNextImage(dec);
+	}
+	if (r == AVIF_RESULT_OK) {
+		avifRGBImageSetDefaults(rgb, dec->image);
+		rgb->format = AVIF_RGB_FORMAT_RGBA;
+		rgb->depth = 8;
+#if AVIF_VERSION >= 1000000
+		r = avifRGBImageAllocatePixels(rgb);
+#else
+		avifRGBImageAllocatePixels(rgb); // returns void before libavif 1.0
+#endif
+		if (r == AVIF_RESULT_OK && rgb->pixels == NULL) {
+			r = AVIF_RESULT_OUT_OF_MEMORY;
+		}
+		if (r == AVIF_RESULT_OK && (r = avifImageYUVToRGB(dec->image, rgb)) != AVIF_RESULT_OK) {
+			avifRGBImageFreePixels(rgb);
+		}
+	}
+	avifDecoderDestroy(dec);
+	return r;
+}
+
+// decodeSize reads the image dimensions from the container header
+static avifResult decodeSize(const uint8_t *data, size_t size, uint32_t *w, uint32_t *h) {
+	avifDecoder *dec = avifDecoderCreate();
+	if (dec == NULL) {
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+	avifResult r = avifDecoderSetIOMemory(dec, data, size);
+	if (r == AVIF_RESULT_OK) {
+		r = avifDecoderParse(dec);
+	}
+	if (r == AVIF_RESULT_OK) {
+		*w = dec->image->width;
+		*h = dec->image->height;
+	}
+	avifDecoderDestroy(dec);
+	return r;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"runtime"
+	"unsafe"
+
+	"github.com/disintegration/imaging"
+
+	"github.com/menta2k/image-analyzer/pkg/processing"
+)
+
+// Speed is the libavif encoder speed, 0 (slowest, smallest files) to 10 (fastest)
+var Speed = 8
+
+func init() {
+	processing.RegisterAVIFEncoder(Encode)
+	image.RegisterFormat("avif", "????ftypavif", Decode, DecodeConfig)
+}
+
+// Encode writes img to w as 8-bit 4:2:0 AVIF at the given quality (1-100)
+func Encode(w io.Writer, img image.Image, quality int) error {
+	if quality < 1 || quality > 100 {
+		return fmt.Errorf("quality %d is not between 1 and 100", quality)
+	}
+	n, ok := img.(*image.NRGBA)
+	if !ok || n.Rect.Min != (image.Point{}) {
+		n = imaging.Clone(img)
+	}
+	if n.Rect.Empty() {
+		return errors.New("empty image")
+	}
+	ignoreAlpha := 0
+	if n.Opaque() {
+		ignoreAlpha = 1
+	}
+	quantizer := (100 - quality) * 63 / 99
+
+	var out C.avifRWData
+	r := C.encodeRGBA((*C.uint8_t)(unsafe.Pointer(&n.Pix[0])), C.uint32_t(n.Rect.Dx()), C.uint32_t(n.Rect.Dy()),
+		C.uint32_t(n.Stride), C.int(ignoreAlpha), C.int(quantizer), C.int(Speed), C.int(runtime.NumCPU()), &out)
+	if r != C.AVIF_RESULT_OK {
+		return fmt.Errorf("libavif: %s", C.GoString(C.avifResultToString(r)))
+	}
+	defer C.avifRWDataFree(&out)
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out.data), C.int(out.size)))
+	return err
+}
+
+// Decode reads the first frame of an AVIF image
+func Decode(r io.Reader) (image.Image, error) {
+	data, err := readAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var rgb C.avifRGBImage
+	if res := C.decodeRGBA((*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)), &rgb); res != C.AVIF_RESULT_OK {
+		return nil, fmt.Errorf("libavif: %s", C.GoString(C.avifResultToString(res)))
+	}
+	defer C.avifRGBImageFreePixels(&rgb)
+	w, h, stride := int(rgb.width), int(rgb.height), int(rgb.rowBytes)
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	pix := unsafe.Slice((*byte)(unsafe.Pointer(rgb.pixels)), stride*h)
+	for y := 0; y < h; y++ {
+		copy(img.Pix[y*img.Stride:y*img.Stride+4*w], pix[y*stride:])
+	}
+	return img, nil
+}
+
+// DecodeConfig returns the dimensions of an AVIF image without decoding its pixels
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	data, err := readAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	var w, h C.uint32_t
+	if res := C.decodeSize((*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)), &w, &h); res != C.AVIF_RESULT_OK {
+		return image.Config{}, fmt.Errorf("libavif: %s", C.GoString(C.avifResultToString(res)))
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: int(w), Height: int(h)}, nil
+}
+
+// readAll reads the whole input; libavif parses from memory
+func readAll(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("avif: empty input")
+	}
+	return data, nil
+}
@@ -2,8 +2,17 @@ package detection
 
 import (
 	"context"
+	"fmt"
 	"math"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/menta2k/image-analyzer/pkg/client"
 	"github.com/menta2k/image-analyzer/pkg/types"
@@ -12,6 +21,9 @@ import (
 // SimpleTestPrompt for testing if the model can see images
 const SimpleTestPrompt = `What do you see in this image? Describe it briefly.`
 
+// DefaultCenterTolerance is the default allowed offset of the box center from the image center
+const DefaultCenterTolerance = 0.10
+
 // DefaultPrompt is the default prompt for subject detection
 const DefaultPrompt = `You are an image subject locator.
 
@@ -30,7 +42,7 @@ Return JSON only:
 
 HARD RULES
 - All coordinates are normalized to [0,1] (NOT pixels).
-- The box center must satisfy: abs(cx - 0.5) <= 0.10 and abs(cy - 0.5) <= 0.10.
+- The box center must satisfy: abs(cx - 0.5) <= 0.1 and abs(cy - 0.5) <= 0.1.
 - If your best box violates it, ADJUST the box so its center lies on the nearest allowed boundary.
 - The box should tightly include the visually dominant subject (prefer people/vehicles/animals; else the most central salient object).
 - Description must be brief and factual. Do not guess real identities.
@@ -43,32 +55,227 @@ HARD RULES
   }
 - JSON only. No markdown, no code fences, no comments, no trailing commas.`
 
+// defaultCenterRule is the center rule of DefaultPrompt, stated for DefaultCenterTolerance
+const defaultCenterRule = "abs(cx - 0.5) <= 0.1 and abs(cy - 0.5) <= 0.1"
+
+// BuildPrompt renders the default detection prompt with the given center tolerance
+func BuildPrompt(centerTolerance float64) string {
+	tol := strconv.FormatFloat(clamp(centerTolerance, 0, 0.5), 'f', -1, 64)
+	return strings.Replace(DefaultPrompt, defaultCenterRule, "abs(cx - 0.5) <= "+tol+" and abs(cy - 0.5) <= "+tol, 1)
+}
+
+// detectionsAddendum asks the model to also localize every tagged object
+const detectionsAddendum = `
+
+ALSO LIST OBJECTS
+- Add a "detections" array to the same JSON object with one entry per object you can localize (tagged objects first):
+  "detections": [{"label": "string", "confidence": 0.0, "box": {"x": 0.0, "y": 0.0, "w": 0.0, "h": 0.0}, "cx": 0.0, "cy": 0.0}]
+- Detection boxes are normalized to [0,1] and are NOT subject to the center rule.
+- Use an empty array if nothing can be localized.`
+
+// BuildMultiPrompt renders the detection prompt that also requests a box for every object
+func BuildMultiPrompt(centerTolerance float64) string {
+	return BuildPrompt(centerTolerance) + detectionsAddendum
+}
+
+// languageAddendum asks for localized free text while keeping the machine-read parts in English
+const languageAddendum = `
+
+LANGUAGE
+- Write "description" and "tags" in %s.
+- Keep the JSON keys, the "label" values and the coordinate rules above in English.`
+
+// BuildLanguageInstruction renders the prompt addendum requesting description and tags in
+// language; it is empty when language is empty
+func BuildLanguageInstruction(language string) string {
+	language = strings.TrimSpace(language)
+	if language == "" {
+		return ""
+	}
+	return fmt.Sprintf(languageAddendum, language)
+}
+
+// DefaultStreamWorkers is the default number of concurrent detections in DetectStream
+const DefaultStreamWorkers = 2
+
+// ImageJob is a single image submitted to DetectStream
+type ImageJob struct {
+	ID       string
+	ImageB64 string
+}
+
+// DetectResult is the outcome of an ImageJob emitted by DetectStream
+type DetectResult struct {
+	ID     string
+	Result *types.AnalysisResult
+	Err    error
+}
+
+// tracer records spans for detection calls; it is a no-op unless an OpenTelemetry provider is installed
+var tracer = otel.Tracer("github.com/menta2k/image-analyzer/pkg/detection")
+
 // Detector handles image subject detection using vision models
 type Detector struct {
-	client client.VisionClient
+	client          client.VisionClient
+	defaultModel    string
+	centerTolerance float64
+	streamWorkers   int
+	allowedLabels   map[string]struct{}
+	multiDetect     bool
+	minConfidence   float64
+	language        string
+	mergeIoU        float64
+	mergePad        float64
 }
 
 // NewDetector creates a new detector with a vision client
 func NewDetector(client client.VisionClient) *Detector {
-	return &Detector{client: client}
+	return &Detector{client: client, centerTolerance: DefaultCenterTolerance, streamWorkers: DefaultStreamWorkers}
+}
+
+// NewDetectorWithModel creates a detector that uses defaultModel whenever a call passes an empty model
+func NewDetectorWithModel(client client.VisionClient, defaultModel string) *Detector {
+	d := NewDetector(client)
+	d.defaultModel = defaultModel
+	return d
+}
+
+// modelOrDefault returns model, or the detector's default model when model is empty
+func (d *Detector) modelOrDefault(model string) string {
+	if model == "" {
+		return d.defaultModel
+	}
+	return model
+}
+
+// SetCenterTolerance sets how far (normalized) the box center may be from the image center.
+// A tolerance of 0.5 effectively disables the constraint.
+func (d *Detector) SetCenterTolerance(tolerance float64) {
+	d.centerTolerance = clamp(tolerance, 0, 0.5)
+}
+
+// SetAllowedLabels restricts detections to the given labels (case-insensitive);
+// any other label is turned into the "none" fallback. An empty list allows every label.
+func (d *Detector) SetAllowedLabels(labels []string) {
+	d.allowedLabels = nil
+	for _, l := range labels {
+		l = strings.ToLower(strings.TrimSpace(l))
+		if l == "" {
+			continue
+		}
+		if d.allowedLabels == nil {
+			d.allowedLabels = map[string]struct{}{}
+		}
+		d.allowedLabels[l] = struct{}{}
+	}
+}
+
+// SetMultiDetect makes DetectSubject also request a box for every object, returned in Detections
+func (d *Detector) SetMultiDetect(enabled bool) {
+	d.multiDetect = enabled
+}
+
+// SetMinConfidence drops Detections whose confidence is below min (the primary subject is kept)
+func (d *Detector) SetMinConfidence(min float64) {
+	d.minConfidence = clamp(min, 0, 1)
+}
+
+// SetMergeOverlap merges Detections of the same label whose boxes overlap by more than iou
+// (intersection over union) into one box covering both, grown by pad of its size on each side
+// (see MergeOverlapping). iou <= 0 disables merging.
+func (d *Detector) SetMergeOverlap(iou, pad float64) {
+	d.mergeIoU = clamp(iou, 0, 1)
+	d.mergePad = clamp(pad, 0, 0.5)
+}
+
+// SetLanguage asks the model for description and tags in the given language (e.g. "Spanish");
+// labels, keys and coordinates stay in English. An empty language keeps the default.
+func (d *Detector) SetLanguage(language string) {
+	d.language = strings.TrimSpace(language)
 }
 
 // DetectSubject analyzes an image and detects the primary subject
 func (d *Detector) DetectSubject(ctx context.Context, model, imageB64 string) (*types.AnalysisResult, error) {
-	result, err := d.DetectSubjectWithPrompt(ctx, model, imageB64, DefaultPrompt)
+	model = d.modelOrDefault(model)
+	ctx, span := tracer.Start(ctx, "detection.DetectSubject", trace.WithAttributes(
+		attribute.String("model", model),
+		attribute.Int("image.b64_bytes", len(imageB64)),
+	))
+	defer span.End()
+
+	prompt := BuildPrompt(d.centerTolerance)
+	if d.multiDetect {
+		prompt = BuildMultiPrompt(d.centerTolerance)
+	}
+	prompt += BuildLanguageInstruction(d.language)
+	result, err := d.DetectSubjectWithPrompt(ctx, model, imageB64, prompt)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
 
 	// Validate and adjust result based on confidence and common sense
 	result = d.validateAndAdjustResult(result)
 
+	span.SetAttributes(
+		attribute.String("subject.label", result.Primary.Label),
+		attribute.Float64("subject.confidence", result.Primary.Confidence),
+		attribute.Int("detections", len(result.Detections)),
+	)
 	return result, nil
 }
 
+// DetectSubjectDefault detects the primary subject using the detector's default model
+func (d *Detector) DetectSubjectDefault(ctx context.Context, imageB64 string) (*types.AnalysisResult, error) {
+	return d.DetectSubject(ctx, "", imageB64)
+}
+
+// SetStreamWorkers sets how many images DetectStream analyzes concurrently
+func (d *Detector) SetStreamWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	d.streamWorkers = n
+}
+
+// DetectStream detects subjects for every job read from in and sends one result per job to out.
+// Jobs are processed by a bounded worker pool, so results may arrive out of order.
+// out is closed once in is drained (or ctx is cancelled) and all workers have finished.
+func (d *Detector) DetectStream(ctx context.Context, model string, in <-chan ImageJob, out chan<- DetectResult) {
+	var wg sync.WaitGroup
+	for i := 0; i < d.streamWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var job ImageJob
+				var ok bool
+				select {
+				case <-ctx.Done():
+					return
+				case job, ok = <-in:
+					if !ok {
+						return
+					}
+				}
+
+				result, err := d.DetectSubject(ctx, model, job.ImageB64)
+				select {
+				case out <- DetectResult{ID: job.ID, Result: result, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(out)
+}
+
 // DetectSubjectWithPrompt analyzes an image with a custom prompt
 func (d *Detector) DetectSubjectWithPrompt(ctx context.Context, model, imageB64, prompt string) (*types.AnalysisResult, error) {
-	result, err := d.client.AnalyzeImage(ctx, model, prompt, imageB64)
+	result, err := d.client.AnalyzeImage(ctx, d.modelOrDefault(model), prompt, imageB64)
 	if err != nil {
 		return nil, err
 	}
@@ -76,14 +283,227 @@ func (d *Detector) DetectSubjectWithPrompt(ctx context.Context, model, imageB64,
 	// Post-process the result
 	result.Primary.Box = normalizeBox(result.Primary.Box, 1, 1) // Already normalized but ensure bounds
 	result.Tags = normalizeTags(result.Tags)
+	result.Detections = d.normalizeDetections(result.Detections)
 
 	return result, nil
 }
 
+// DetectSubjectVoting asks the model once per prompt and combines the answers by vote.
+// Fallback answers ("none", unparseable or unclear responses) and failed calls are discarded;
+// the most common label wins (ties go to the higher total confidence), the box and center are
+// the per-edge medians of the winning answers, and tags are merged from every usable answer.
+// If no answer is usable the first one is returned; if every call fails the first error is.
+func (d *Detector) DetectSubjectVoting(ctx context.Context, model, imageB64 string, prompts []string) (*types.AnalysisResult, error) {
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("no prompts to vote with")
+	}
+	model = d.modelOrDefault(model)
+	ctx, span := tracer.Start(ctx, "detection.DetectSubjectVoting", trace.WithAttributes(
+		attribute.String("model", model),
+		attribute.Int("prompts", len(prompts)),
+	))
+	defer span.End()
+
+	results := make([]*types.AnalysisResult, len(prompts))
+	errs := make([]error, len(prompts))
+	var wg sync.WaitGroup
+	for i, prompt := range prompts {
+		wg.Add(1)
+		go func(i int, prompt string) {
+			defer wg.Done()
+			results[i], errs[i] = d.DetectSubjectWithPrompt(ctx, model, imageB64, prompt)
+		}(i, prompt)
+	}
+	wg.Wait()
+
+	var first *types.AnalysisResult
+	var firstErr error
+	var usable []*types.AnalysisResult
+	for i, r := range results {
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		r = d.validateAndAdjustResult(r)
+		if first == nil {
+			first = r
+		}
+		if r.Primary.Label != "none" {
+			usable = append(usable, r)
+		}
+	}
+	if first == nil {
+		span.RecordError(firstErr)
+		span.SetStatus(codes.Error, firstErr.Error())
+		return nil, firstErr
+	}
+	span.SetAttributes(attribute.Int("votes", len(usable)))
+	if len(usable) == 0 {
+		return first, nil
+	}
+
+	// Tally labels case-insensitively
+	votes := map[string]int{}
+	weight := map[string]float64{}
+	for _, r := range usable {
+		label := strings.ToLower(strings.TrimSpace(r.Primary.Label))
+		votes[label]++
+		weight[label] += r.Primary.Confidence
+	}
+	var winner string
+	for label := range votes {
+		if winner == "" || votes[label] > votes[winner] ||
+			(votes[label] == votes[winner] && weight[label] > weight[winner]) ||
+			(votes[label] == votes[winner] && weight[label] == weight[winner] && label < winner) {
+			winner = label
+		}
+	}
+
+	var x0, y0, x1, y1, cx, cy, conf []float64
+	var best *types.AnalysisResult
+	var tags []string
+	for _, r := range usable {
+		tags = append(tags, r.Tags...)
+		if strings.ToLower(strings.TrimSpace(r.Primary.Label)) != winner {
+			continue
+		}
+		if best == nil || r.Primary.Confidence > best.Primary.Confidence {
+			best = r
+		}
+		b := r.Primary.Box
+		x0, y0 = append(x0, b.X), append(y0, b.Y)
+		x1, y1 = append(x1, b.X+b.W), append(y1, b.Y+b.H)
+		cx, cy = append(cx, r.Primary.Cx), append(cy, r.Primary.Cy)
+		conf = append(conf, r.Primary.Confidence)
+	}
+
+	merged := &types.AnalysisResult{Description: best.Description}
+	merged.Primary.Label = best.Primary.Label
+	merged.Primary.Confidence = median(conf)
+	left, top := median(x0), median(y0)
+	merged.Primary.Box = normalizeBox(types.Box{X: left, Y: top, W: median(x1) - left, H: median(y1) - top}, 1, 1)
+	merged.Primary.Cx, merged.Primary.Cy = median(cx), median(cy)
+	merged.Tags = normalizeTags(tags)
+	merged.Detections = best.Detections
+
+	merged = d.validateAndAdjustResult(merged)
+	span.SetAttributes(
+		attribute.String("subject.label", merged.Primary.Label),
+		attribute.Float64("subject.confidence", merged.Primary.Confidence),
+	)
+	return merged, nil
+}
+
+// median returns the middle value of vs, averaging the two middle values for even lengths
+func median(vs []float64) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	s := append([]float64(nil), vs...)
+	sort.Float64s(s)
+	mid := len(s) / 2
+	if len(s)%2 == 0 {
+		return (s[mid-1] + s[mid]) / 2
+	}
+	return s[mid]
+}
+
 // TestVision tests if the model can actually see the image with a simple prompt
 func (d *Detector) TestVision(ctx context.Context, model, imageB64 string) (string, error) {
 	// Use the ollama client directly for a simple text response
-	return d.client.SimpleQuery(ctx, model, SimpleTestPrompt, imageB64)
+	return d.client.SimpleQuery(ctx, d.modelOrDefault(model), SimpleTestPrompt, imageB64)
+}
+
+// normalizeDetections bounds every detection box, fills missing centers from the box
+// and drops unlabeled, low-confidence or disallowed entries
+func (d *Detector) normalizeDetections(dets []types.Primary) []types.Primary {
+	out := dets[:0]
+	for _, det := range dets {
+		det.Label = strings.TrimSpace(det.Label)
+		if det.Label == "" || strings.ToLower(det.Label) == "none" || det.Confidence < d.minConfidence {
+			continue
+		}
+		if d.allowedLabels != nil {
+			if _, ok := d.allowedLabels[strings.ToLower(det.Label)]; !ok {
+				continue
+			}
+		}
+		det.Box = normalizeBox(det.Box, 1, 1)
+		if det.Box.W <= 0 || det.Box.H <= 0 {
+			continue
+		}
+		if det.Cx <= 0 && det.Cy <= 0 {
+			det.Cx = det.Box.X + det.Box.W/2
+			det.Cy = det.Box.Y + det.Box.H/2
+		}
+		det.Cx = clamp(det.Cx, 0, 1)
+		det.Cy = clamp(det.Cy, 0, 1)
+		out = append(out, det)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	if d.mergeIoU > 0 {
+		out = MergeOverlapping(out, d.mergeIoU, d.mergePad)
+	}
+	return out
+}
+
+// BoxIoU returns the intersection over union of two normalized boxes
+func BoxIoU(a, b types.Box) float64 {
+	iw := math.Min(a.X+a.W, b.X+b.W) - math.Max(a.X, b.X)
+	ih := math.Min(a.Y+a.H, b.Y+b.H) - math.Max(a.Y, b.Y)
+	if iw <= 0 || ih <= 0 {
+		return 0
+	}
+	inter := iw * ih
+	return inter / (a.W*a.H + b.W*b.H - inter)
+}
+
+// MergeOverlapping unions detections of the same label (case-insensitive) whose boxes overlap
+// by more than iou into a single box covering both, instead of dropping all but one as
+// non-maximum suppression would (which can truncate the subject). A merged entry keeps the
+// label and the highest confidence, is grown by pad of its size on every side (clamped to
+// the image) and is centered on its box. Merging repeats until no pair qualifies.
+func MergeOverlapping(dets []types.Primary, iou, pad float64) []types.Primary {
+	if iou <= 0 || len(dets) < 2 {
+		return dets
+	}
+	out := append([]types.Primary(nil), dets...)
+	merged := make([]bool, len(out))
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(out) && !changed; i++ {
+			for j := i + 1; j < len(out); j++ {
+				if !strings.EqualFold(out[i].Label, out[j].Label) || BoxIoU(out[i].Box, out[j].Box) <= iou {
+					continue
+				}
+				a, b := out[i].Box, out[j].Box
+				x0, y0 := math.Min(a.X, b.X), math.Min(a.Y, b.Y)
+				x1, y1 := math.Max(a.X+a.W, b.X+b.W), math.Max(a.Y+a.H, b.Y+b.H)
+				out[i].Box = types.Box{X: x0, Y: y0, W: x1 - x0, H: y1 - y0}
+				out[i].Confidence = math.Max(out[i].Confidence, out[j].Confidence)
+				merged[i] = true
+				out = append(out[:j], out[j+1:]...)
+				merged = append(merged[:j], merged[j+1:]...)
+				changed = true
+				break
+			}
+		}
+	}
+	for i := range out {
+		if !merged[i] {
+			continue
+		}
+		b := out[i].Box
+		x0, y0 := clamp(b.X-b.W*pad, 0, 1), clamp(b.Y-b.H*pad, 0, 1)
+		x1, y1 := clamp(b.X+b.W*(1+pad), 0, 1), clamp(b.Y+b.H*(1+pad), 0, 1)
+		out[i].Box = types.Box{X: x0, Y: y0, W: x1 - x0, H: y1 - y0}
+		out[i].Cx, out[i].Cy = x0+(x1-x0)/2, y0+(y1-y0)/2
+	}
+	return out
 }
 
 // validateAndAdjustResult validates the detection result and adjusts for reliability
@@ -95,11 +515,12 @@ func (d *Detector) validateAndAdjustResult(result *types.AnalysisResult) *types.
 	}
 
 	// Normalize the bounding box based on the center constraint
-	// The prompt requires abs(cx - 0.5) <= 0.10 and abs(cy - 0.5) <= 0.10
-	if math.Abs(result.Primary.Cx-0.5) > 0.10 || math.Abs(result.Primary.Cy-0.5) > 0.10 {
+	// The prompt requires abs(cx - 0.5) <= tol and abs(cy - 0.5) <= tol
+	tol := d.centerTolerance
+	if math.Abs(result.Primary.Cx-0.5) > tol || math.Abs(result.Primary.Cy-0.5) > tol {
 		// Adjust to nearest valid center
-		result.Primary.Cx = clamp(result.Primary.Cx, 0.4, 0.6)
-		result.Primary.Cy = clamp(result.Primary.Cy, 0.4, 0.6)
+		result.Primary.Cx = clamp(result.Primary.Cx, 0.5-tol, 0.5+tol)
+		result.Primary.Cy = clamp(result.Primary.Cy, 0.5-tol, 0.5+tol)
 	}
 
 	// If any fallback indicators are present, ensure it's marked as such
@@ -115,9 +536,132 @@ func (d *Detector) validateAndAdjustResult(result *types.AnalysisResult) *types.
 		}
 	}
 
+	// Labels outside the allow-list count as no subject, centered like the prompt's fallback
+	if d.allowedLabels != nil && result.Primary.Label != "none" {
+		if _, ok := d.allowedLabels[strings.ToLower(strings.TrimSpace(result.Primary.Label))]; !ok {
+			result.Primary = types.Primary{
+				Label: "none",
+				Box:   types.Box{X: 0.25, Y: 0.25, W: 0.5, H: 0.5},
+				Cx:    0.5,
+				Cy:    0.5,
+			}
+		}
+	}
+
 	return result
 }
 
+// EnsembleResults merges results for the same image from several models into one.
+// Primary boxes and centers are averaged weighted by confidence, the label and description
+// come from the most confident result, and tags are unioned (most confident first).
+// "none" results are ignored; if every result is "none" the first one is returned.
+func EnsembleResults(results []*types.AnalysisResult) *types.AnalysisResult {
+	var usable []*types.AnalysisResult
+	var first *types.AnalysisResult
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		if first == nil {
+			first = r
+		}
+		if strings.ToLower(r.Primary.Label) != "none" {
+			usable = append(usable, r)
+		}
+	}
+	if len(usable) == 0 {
+		return first
+	}
+
+	sort.SliceStable(usable, func(i, j int) bool {
+		return usable[i].Primary.Confidence > usable[j].Primary.Confidence
+	})
+	best := usable[0]
+
+	var totalWeight, confSum float64
+	for _, r := range usable {
+		totalWeight += math.Max(r.Primary.Confidence, 0)
+		confSum += r.Primary.Confidence
+	}
+
+	merged := &types.AnalysisResult{Description: best.Description}
+	merged.Primary.Label = best.Primary.Label
+	merged.Primary.Confidence = confSum / float64(len(usable))
+	var tags []string
+	for _, r := range usable {
+		// Fall back to equal weights when no result reports a confidence
+		weight := 1 / float64(len(usable))
+		if totalWeight > 0 {
+			weight = math.Max(r.Primary.Confidence, 0) / totalWeight
+		}
+		merged.Primary.Box.X += r.Primary.Box.X * weight
+		merged.Primary.Box.Y += r.Primary.Box.Y * weight
+		merged.Primary.Box.W += r.Primary.Box.W * weight
+		merged.Primary.Box.H += r.Primary.Box.H * weight
+		merged.Primary.Cx += r.Primary.Cx * weight
+		merged.Primary.Cy += r.Primary.Cy * weight
+		tags = append(tags, r.Tags...)
+	}
+	merged.Primary.Box = normalizeBox(merged.Primary.Box, 1, 1)
+	merged.Tags = normalizeTags(tags)
+	return merged
+}
+
+// MinRepairBoxPx is the smallest box side, in pixels, RepairResult leaves in place
+const MinRepairBoxPx = 8
+
+// RepairResult returns a copy of result whose boxes are made sane for an imgW x imgH image:
+// pixel boxes are normalized, boxes are clamped inside the image and grown to at least
+// MinRepairBoxPx per side, and centers that fall outside their box are reset to its middle
+func RepairResult(result *types.AnalysisResult, imgW, imgH int) *types.AnalysisResult {
+	if result == nil {
+		return nil
+	}
+	repaired := *result
+	repaired.Primary = repairPrimary(result.Primary, imgW, imgH)
+	if len(result.Detections) > 0 {
+		repaired.Detections = make([]types.Primary, len(result.Detections))
+		for i, det := range result.Detections {
+			repaired.Detections[i] = repairPrimary(det, imgW, imgH)
+		}
+	}
+	return &repaired
+}
+
+// repairPrimary applies RepairResult to a single subject
+func repairPrimary(p types.Primary, imgW, imgH int) types.Primary {
+	if imgW <= 0 || imgH <= 0 {
+		return p
+	}
+	b := normalizeBox(p.Box, imgW, imgH)
+	// Model centers are in the same units as its box
+	if p.Box.X > 1 || p.Box.Y > 1 || p.Box.W > 1 || p.Box.H > 1 {
+		p.Cx /= float64(imgW)
+		p.Cy /= float64(imgH)
+	}
+	b.W = math.Min(b.W, 1-b.X)
+	b.H = math.Min(b.H, 1-b.Y)
+
+	// Grow tiny boxes around their center, shifting them back inside the image
+	minW := math.Min(float64(MinRepairBoxPx)/float64(imgW), 1)
+	minH := math.Min(float64(MinRepairBoxPx)/float64(imgH), 1)
+	if b.W < minW {
+		b.X = clamp(b.X+b.W/2-minW/2, 0, 1-minW)
+		b.W = minW
+	}
+	if b.H < minH {
+		b.Y = clamp(b.Y+b.H/2-minH/2, 0, 1-minH)
+		b.H = minH
+	}
+	p.Box = b
+
+	if p.Cx < b.X || p.Cx > b.X+b.W || p.Cy < b.Y || p.Cy > b.Y+b.H {
+		p.Cx = b.X + b.W/2
+		p.Cy = b.Y + b.H/2
+	}
+	return p
+}
+
 // clamp ensures a value is within the given bounds
 func clamp(v, lo, hi float64) float64 {
 	if v < lo {
@@ -159,12 +703,14 @@ func normalizeBox(b types.Box, imgW, imgH int) types.Box {
 	}
 }
 
-// normalizeTags ensures tags are cleaned and limited to 5 entries
+// normalizeTags ensures tags are cleaned and limited to 5 entries. It is Unicode-aware:
+// invalid UTF-8 is dropped, any Unicode whitespace is collapsed and case is folded per rune,
+// so localized tags ("niño", "собака", "猫") survive intact.
 func normalizeTags(tags []string) []string {
 	seen := map[string]struct{}{}
 	out := make([]string, 0, 5)
 	for _, t := range tags {
-		t = strings.ToLower(strings.TrimSpace(t))
+		t = strings.ToLower(strings.Join(strings.Fields(strings.ToValidUTF8(t, "")), " "))
 		if t == "" {
 			continue
 		}
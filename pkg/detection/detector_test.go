@@ -0,0 +1,506 @@
+package detection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/menta2k/image-analyzer/pkg/llamacpp"
+	"github.com/menta2k/image-analyzer/pkg/ollama"
+	"github.com/menta2k/image-analyzer/pkg/types"
+)
+
+func TestCenterTolerance(t *testing.T) {
+	tests := []struct {
+		name           string
+		tolerance      float64
+		cx, cy         float64
+		wantCx, wantCy float64
+		wantPrompt     string
+	}{
+		{"default clamps", DefaultCenterTolerance, 0.25, 0.5, 0.4, 0.5, "<= 0.1"},
+		{"0.3 lets cx=0.25 through", 0.3, 0.25, 0.5, 0.25, 0.5, "<= 0.3"},
+		{"0.3 clamps beyond", 0.3, 0.1, 0.9, 0.2, 0.8, "<= 0.3"},
+		{"0.5 disables", 0.5, 0.02, 0.98, 0.02, 0.98, "<= 0.5"},
+		{"above 0.5 is 0.5", 2, 0.02, 0.98, 0.02, 0.98, "<= 0.5"},
+		{"negative is 0", -1, 0.6, 0.4, 0.5, 0.5, "<= 0"},
+		{"0.125 is not rounded", 0.125, 0.37, 0.65, 0.375, 0.625, "<= 0.125"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDetector(nil)
+			d.SetCenterTolerance(tt.tolerance)
+			result := d.validateAndAdjustResult(&types.AnalysisResult{
+				Primary: types.Primary{Label: "dog", Confidence: 0.9, Cx: tt.cx, Cy: tt.cy},
+			})
+			if result.Primary.Cx != tt.wantCx || result.Primary.Cy != tt.wantCy {
+				t.Errorf("center = (%v, %v), want (%v, %v)", result.Primary.Cx, result.Primary.Cy, tt.wantCx, tt.wantCy)
+			}
+			// The prompt states the same tolerance the validation applies
+			if prompt := BuildPrompt(d.centerTolerance); !strings.Contains(prompt, "abs(cx - 0.5) "+tt.wantPrompt+" and abs(cy - 0.5) "+tt.wantPrompt+".") {
+				t.Errorf("prompt does not require abs(cx - 0.5) %s", tt.wantPrompt)
+			}
+		})
+	}
+	if BuildPrompt(DefaultCenterTolerance) != DefaultPrompt {
+		t.Error("BuildPrompt(DefaultCenterTolerance) differs from DefaultPrompt")
+	}
+}
+
+// fakeClient is a VisionClient whose AnalyzeImage calls analyze
+type fakeClient struct {
+	analyze func(ctx context.Context, model, prompt, imgB64 string) (*types.AnalysisResult, error)
+}
+
+func (f *fakeClient) SimpleQuery(ctx context.Context, model, prompt, imgB64 string) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (f *fakeClient) AnalyzeImage(ctx context.Context, model, prompt, imgB64 string) (*types.AnalysisResult, error) {
+	return f.analyze(ctx, model, prompt, imgB64)
+}
+
+// subject returns a centered detection with the given label
+func subject(label string) *types.AnalysisResult {
+	return &types.AnalysisResult{Primary: types.Primary{
+		Label: label, Confidence: 0.9, Box: types.Box{X: 0.3, Y: 0.3, W: 0.4, H: 0.4}, Cx: 0.5, Cy: 0.5,
+	}}
+}
+
+func TestDetectStream(t *testing.T) {
+	var mu sync.Mutex
+	active, peak := 0, 0
+	d := NewDetector(&fakeClient{analyze: func(ctx context.Context, model, prompt, img string) (*types.AnalysisResult, error) {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		if img == "bad" {
+			return nil, errors.New("model failed")
+		}
+		return subject("label-" + img), nil
+	}})
+	d.SetStreamWorkers(3)
+
+	in := make(chan ImageJob)
+	out := make(chan DetectResult)
+	go d.DetectStream(context.Background(), "m", in, out)
+	go func() {
+		for _, img := range []string{"a", "b", "bad", "c", "d", "e", "f"} {
+			in <- ImageJob{ID: "id-" + img, ImageB64: img}
+		}
+		close(in)
+	}()
+
+	got := map[string]DetectResult{}
+	for r := range out {
+		if _, dup := got[r.ID]; dup {
+			t.Errorf("%s reported twice", r.ID)
+		}
+		got[r.ID] = r
+	}
+	if len(got) != 7 {
+		t.Fatalf("%d results, want 7", len(got))
+	}
+	for id, r := range got {
+		if id == "id-bad" {
+			if r.Err == nil || r.Result != nil {
+				t.Errorf("%s: result %v err %v, want only an error", id, r.Result, r.Err)
+			}
+			continue
+		}
+		if r.Err != nil || r.Result.Primary.Label != "label-"+id[3:] {
+			t.Errorf("%s: result %+v err %v", id, r.Result, r.Err)
+		}
+	}
+	if peak > 3 {
+		t.Errorf("%d detections ran at once, want at most 3 workers", peak)
+	}
+
+	// Cancelling stops the workers and still closes out
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	out = make(chan DetectResult)
+	done := make(chan struct{})
+	go func() {
+		d.DetectStream(ctx, "m", make(chan ImageJob), out)
+		close(done)
+	}()
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("a cancelled stream produced a result")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("out was not closed after cancellation")
+	}
+	<-done
+}
+
+// spanRecorder is a TracerProvider that records the names of the spans started through it
+type spanRecorder struct {
+	embedded.TracerProvider
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *spanRecorder) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return &recordingTracer{Tracer: noop.NewTracerProvider().Tracer(name), rec: r}
+}
+
+func (r *spanRecorder) started() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.names...)
+}
+
+type recordingTracer struct {
+	trace.Tracer
+	rec *spanRecorder
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t.rec.mu.Lock()
+	t.rec.names = append(t.rec.names, name)
+	t.rec.mu.Unlock()
+	return t.Tracer.Start(ctx, name, opts...)
+}
+
+// analysisJSON is a model answer for a centered dog
+const analysisJSON = `{"primary":{"label":"dog","confidence":0.9,"box":{"x":0.3,"y":0.3,"w":0.4,"h":0.4},"cx":0.5,"cy":0.5},"description":"a dog","tags":["dog"]}`
+
+func TestTracingSpans(t *testing.T) {
+	// The package tracers were created at init and delegate to the provider installed here
+	rec := &spanRecorder{}
+	otel.SetTracerProvider(rec)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/chat":
+			fmt.Fprintf(w, `{"model":"m","message":{"role":"assistant","content":%q},"done":true}`, analysisJSON)
+		default:
+			fmt.Fprintf(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":%q}}]}`, analysisJSON)
+		}
+	}))
+	defer srv.Close()
+
+	llama, err := llamacpp.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oll, err := ollama.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		detect *Detector
+		span   string
+	}{
+		{"llamacpp", NewDetector(llama), "llamacpp.sendRequest"},
+		{"ollama", NewDetector(oll), "ollama.chat"},
+	} {
+		before := len(rec.started())
+		result, err := tc.detect.DetectSubject(context.Background(), "m", "aW1n")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if result.Primary.Label != "dog" {
+			t.Errorf("%s: label %q", tc.name, result.Primary.Label)
+		}
+		spans := rec.started()[before:]
+		if len(spans) != 2 || spans[0] != "detection.DetectSubject" || spans[1] != tc.span {
+			t.Errorf("%s: spans %v, want [detection.DetectSubject %s]", tc.name, spans, tc.span)
+		}
+	}
+}
+
+func TestDefaultModel(t *testing.T) {
+	var models []string
+	fake := &fakeClient{analyze: func(ctx context.Context, model, prompt, img string) (*types.AnalysisResult, error) {
+		models = append(models, model)
+		return subject("dog"), nil
+	}}
+	d := NewDetectorWithModel(fake, "default-model")
+	if _, err := d.DetectSubjectDefault(context.Background(), "img"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DetectSubject(context.Background(), "", "img"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DetectSubject(context.Background(), "explicit", "img"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDetector(fake).DetectSubject(context.Background(), "", "img"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"default-model", "default-model", "explicit", ""}
+	if len(models) != len(want) {
+		t.Fatalf("models %v, want %v", models, want)
+	}
+	for i := range want {
+		if models[i] != want[i] {
+			t.Errorf("call %d used model %q, want %q", i, models[i], want[i])
+		}
+	}
+}
+
+func TestEnsembleResults(t *testing.T) {
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	a := &types.AnalysisResult{
+		Primary:     types.Primary{Label: "dog", Confidence: 0.9, Box: types.Box{X: 0.2, Y: 0.2, W: 0.4, H: 0.4}, Cx: 0.4, Cy: 0.4},
+		Description: "a dog",
+		Tags:        []string{"dog", "Grass"},
+	}
+	b := &types.AnalysisResult{
+		Primary:     types.Primary{Label: "puppy", Confidence: 0.3, Box: types.Box{X: 0.4, Y: 0.2, W: 0.4, H: 0.6}, Cx: 0.6, Cy: 0.5},
+		Description: "a puppy",
+		Tags:        []string{"puppy", "grass"},
+	}
+	none := &types.AnalysisResult{Primary: types.Primary{Label: "none", Confidence: 0.8, Cx: 0.5, Cy: 0.5}}
+
+	got := EnsembleResults([]*types.AnalysisResult{b, none, a, nil})
+	// Weighted by confidence 0.9 : 0.3, i.e. 3/4 and 1/4; the "none" result is left out
+	if !near(got.Primary.Cx, 0.45) || !near(got.Primary.Cy, 0.425) {
+		t.Errorf("center (%v, %v), want (0.45, 0.425)", got.Primary.Cx, got.Primary.Cy)
+	}
+	if !near(got.Primary.Box.X, 0.25) || !near(got.Primary.Box.H, 0.45) {
+		t.Errorf("box %+v, want x 0.25 and h 0.45", got.Primary.Box)
+	}
+	if got.Primary.Label != "dog" || got.Description != "a dog" || !near(got.Primary.Confidence, 0.6) {
+		t.Errorf("label %q description %q confidence %v, want the most confident label and the mean confidence",
+			got.Primary.Label, got.Description, got.Primary.Confidence)
+	}
+	if len(got.Tags) != 3 || got.Tags[0] != "dog" {
+		t.Errorf("tags %v, want dog, grass and puppy once each, most confident first", got.Tags)
+	}
+
+	if got := EnsembleResults([]*types.AnalysisResult{none, {Primary: types.Primary{Label: "None"}}}); got != none {
+		t.Errorf("all-none ensemble returned %+v, want the first result", got)
+	}
+	if got := EnsembleResults(nil); got != nil {
+		t.Errorf("empty ensemble returned %+v", got)
+	}
+}
+
+func TestAllowedLabels(t *testing.T) {
+	label := "dog"
+	d := NewDetector(&fakeClient{analyze: func(ctx context.Context, model, prompt, img string) (*types.AnalysisResult, error) {
+		return subject(label), nil
+	}})
+	d.SetAllowedLabels([]string{" Dog ", "cat", ""})
+
+	for _, tc := range []struct {
+		label, want string
+	}{
+		{"dog", "dog"},
+		{"CAT", "CAT"},
+		{"car", "none"},
+		{"none", "none"},
+	} {
+		label = tc.label
+		result, err := d.DetectSubject(context.Background(), "m", "img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Primary.Label != tc.want {
+			t.Errorf("%s: label %q, want %q", tc.label, result.Primary.Label, tc.want)
+		}
+		if tc.want == "none" && tc.label != "none" {
+			fallback := types.Primary{Label: "none", Box: types.Box{X: 0.25, Y: 0.25, W: 0.5, H: 0.5}, Cx: 0.5, Cy: 0.5}
+			if result.Primary != fallback {
+				t.Errorf("%s: filtered result %+v, want the centered fallback", tc.label, result.Primary)
+			}
+		}
+	}
+
+	// An empty list allows everything again
+	d.SetAllowedLabels(nil)
+	label = "car"
+	if result, err := d.DetectSubject(context.Background(), "m", "img"); err != nil || result.Primary.Label != "car" {
+		t.Errorf("without an allow-list: %+v, %v", result, err)
+	}
+}
+
+func TestMultiDetect(t *testing.T) {
+	const answer = `{"primary":{"label":"dog","confidence":0.9,"box":{"x":0.3,"y":0.3,"w":0.4,"h":0.4},"cx":0.5,"cy":0.5},
+"description":"a dog and a ball","tags":["dog","ball"],
+"detections":[
+ {"label":"dog","confidence":0.9,"box":{"x":0.3,"y":0.3,"w":0.4,"h":0.4},"cx":0.5,"cy":0.5},
+ {"label":"ball","confidence":0.6,"box":{"x":0.8,"y":0.7,"w":0.4,"h":0.2}},
+ {"label":"shadow","confidence":0.2,"box":{"x":0.1,"y":0.8,"w":0.1,"h":0.1}},
+ {"label":"","confidence":0.9,"box":{"x":0.1,"y":0.1,"w":0.1,"h":0.1}}
+]}`
+	var prompt string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []struct {
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		prompt = req.Messages[0].Content[0].Text
+		fmt.Fprintf(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":%q}}]}`, answer)
+	}))
+	defer srv.Close()
+	llama, err := llamacpp.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDetector(llama)
+	d.SetMultiDetect(true)
+	d.SetMinConfidence(0.5)
+	result, err := d.DetectSubject(context.Background(), "m", "aW1n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(prompt, `"detections"`) {
+		t.Error("the multi-detect prompt does not ask for detections")
+	}
+	if result.Primary.Label != "dog" {
+		t.Errorf("primary %q, want dog", result.Primary.Label)
+	}
+	// The shadow is under the minimum confidence and the unlabeled entry is dropped
+	if len(result.Detections) != 2 || result.Detections[0].Label != "dog" || result.Detections[1].Label != "ball" {
+		t.Fatalf("detections %+v, want dog and ball", result.Detections)
+	}
+	ball := result.Detections[1]
+	if ball.Box.X != 0.8 || ball.Box.W != 0.4 {
+		t.Errorf("ball box %+v, want it kept as reported", ball.Box)
+	}
+	if ball.Cx != 1 || math.Abs(ball.Cy-0.8) > 1e-9 {
+		t.Errorf("ball center (%v, %v), want it filled from the box and clamped to (1, 0.8)", ball.Cx, ball.Cy)
+	}
+
+	// Without multi-detect the plain prompt is used
+	d.SetMultiDetect(false)
+	if _, err := d.DetectSubject(context.Background(), "m", "aW1n"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(prompt, `"detections"`) {
+		t.Error("the single-subject prompt asks for detections")
+	}
+}
+
+func TestMergeOverlapping(t *testing.T) {
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	dets := []types.Primary{
+		{Label: "dog", Confidence: 0.6, Box: types.Box{X: 0.2, Y: 0.2, W: 0.4, H: 0.4}},
+		{Label: "Dog", Confidence: 0.8, Box: types.Box{X: 0.3, Y: 0.2, W: 0.4, H: 0.4}},
+		{Label: "cat", Confidence: 0.7, Box: types.Box{X: 0.3, Y: 0.2, W: 0.4, H: 0.4}},
+		{Label: "dog", Confidence: 0.5, Box: types.Box{X: 0.8, Y: 0.8, W: 0.1, H: 0.1}, Cx: 0.85, Cy: 0.85},
+	}
+	if iou := BoxIoU(dets[0].Box, dets[1].Box); !near(iou, 0.12/0.2) {
+		t.Fatalf("BoxIoU = %v, want 0.6", iou)
+	}
+
+	out := MergeOverlapping(dets, 0.5, 0.1)
+	if len(out) != 3 {
+		t.Fatalf("%d detections, want the two overlapping dogs merged into one of 3", len(out))
+	}
+	// The union 0.2-0.7 x 0.2-0.6 grown by 10% of its size on each side
+	m := out[0]
+	want := types.Box{X: 0.15, Y: 0.16, W: 0.6, H: 0.48}
+	if m.Label != "dog" || m.Confidence != 0.8 || !near(m.Box.X, want.X) || !near(m.Box.Y, want.Y) ||
+		!near(m.Box.W, want.W) || !near(m.Box.H, want.H) || !near(m.Cx, 0.45) || !near(m.Cy, 0.4) {
+		t.Errorf("merged %+v, want dog at %.1f with box %+v centered on it", m, 0.8, want)
+	}
+	// Other labels and boxes that do not overlap enough are untouched
+	if out[1] != dets[2] || out[2] != dets[3] {
+		t.Errorf("untouched detections changed: %+v", out[1:])
+	}
+	if dets[0].Box.X != 0.2 {
+		t.Error("MergeOverlapping modified its input")
+	}
+
+	if out := MergeOverlapping(dets, 0.7, 0.1); len(out) != 4 {
+		t.Errorf("IoU 0.6 merged above a 0.7 threshold: %d detections", len(out))
+	}
+	if out := MergeOverlapping(dets, 0, 0.1); len(out) != 4 {
+		t.Errorf("threshold 0 should disable merging, got %d detections", len(out))
+	}
+}
+
+func TestDetectSubjectVoting(t *testing.T) {
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	answers := map[string]func() (*types.AnalysisResult, error){
+		"p1": func() (*types.AnalysisResult, error) {
+			return &types.AnalysisResult{Primary: types.Primary{Label: "dog", Confidence: 0.7,
+				Box: types.Box{X: 0.30, Y: 0.30, W: 0.40, H: 0.40}, Cx: 0.50, Cy: 0.50}, Tags: []string{"dog"}}, nil
+		},
+		"p2": func() (*types.AnalysisResult, error) {
+			return &types.AnalysisResult{Primary: types.Primary{Label: "Dog", Confidence: 0.9,
+				Box: types.Box{X: 0.32, Y: 0.28, W: 0.40, H: 0.44}, Cx: 0.52, Cy: 0.50}, Description: "best", Tags: []string{"grass"}}, nil
+		},
+		"p3": func() (*types.AnalysisResult, error) {
+			// An outlier box that the median ignores
+			return &types.AnalysisResult{Primary: types.Primary{Label: "dog", Confidence: 0.8,
+				Box: types.Box{X: 0.00, Y: 0.00, W: 0.90, H: 0.90}, Cx: 0.45, Cy: 0.45}}, nil
+		},
+		"p4": func() (*types.AnalysisResult, error) {
+			return &types.AnalysisResult{Primary: types.Primary{Label: "cat", Confidence: 0.95,
+				Box: types.Box{X: 0.1, Y: 0.1, W: 0.2, H: 0.2}, Cx: 0.5, Cy: 0.5}, Tags: []string{"cat"}}, nil
+		},
+		"p5": func() (*types.AnalysisResult, error) {
+			return &types.AnalysisResult{Primary: types.Primary{Label: "none", Cx: 0.5, Cy: 0.5}}, nil
+		},
+		"p6": func() (*types.AnalysisResult, error) { return nil, errors.New("timeout") },
+	}
+	d := NewDetector(&fakeClient{analyze: func(ctx context.Context, model, prompt, img string) (*types.AnalysisResult, error) {
+		return answers[prompt]()
+	}})
+
+	got, err := d.DetectSubjectVoting(context.Background(), "m", "img", []string{"p1", "p2", "p3", "p4", "p5", "p6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three dog votes beat one more confident cat; edges are the medians of the dog answers
+	if got.Primary.Label != "Dog" || got.Description != "best" || !near(got.Primary.Confidence, 0.8) {
+		t.Errorf("label %q description %q confidence %v, want the best dog answer's label with the median confidence",
+			got.Primary.Label, got.Description, got.Primary.Confidence)
+	}
+	b := got.Primary.Box
+	if !near(b.X, 0.30) || !near(b.Y, 0.28) || !near(b.X+b.W, 0.72) || !near(b.Y+b.H, 0.72) {
+		t.Errorf("box %+v, want edges 0.30, 0.28, 0.72, 0.72", b)
+	}
+	if !near(got.Primary.Cx, 0.50) || !near(got.Primary.Cy, 0.50) {
+		t.Errorf("center (%v, %v), want (0.5, 0.5)", got.Primary.Cx, got.Primary.Cy)
+	}
+	if len(got.Tags) != 3 {
+		t.Errorf("tags %v, want dog, grass and cat", got.Tags)
+	}
+
+	// Only fallbacks: the first answer comes back; only failures: the first error
+	if got, err := d.DetectSubjectVoting(context.Background(), "m", "img", []string{"p6", "p5"}); err != nil || got.Primary.Label != "none" {
+		t.Errorf("fallback-only vote: %+v, %v", got, err)
+	}
+	if _, err := d.DetectSubjectVoting(context.Background(), "m", "img", []string{"p6"}); err == nil {
+		t.Error("a vote with only failed calls succeeded")
+	}
+	if _, err := d.DetectSubjectVoting(context.Background(), "m", "img", nil); err == nil {
+		t.Error("a vote without prompts succeeded")
+	}
+}
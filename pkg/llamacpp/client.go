@@ -7,18 +7,36 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/menta2k/image-analyzer/pkg/types"
 )
 
+// tracer records spans for server calls; it is a no-op unless an OpenTelemetry provider is installed
+var tracer = otel.Tracer("github.com/menta2k/image-analyzer/pkg/llamacpp")
+
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
+	sem        chan struct{} // limits in-flight requests, nil = unlimited
+	timeout    time.Duration // applied when the caller's context has no deadline, 0 = none
+	chatPath   string        // chat completions endpoint path, appended to baseURL
 }
 
+// DefaultChatPath is the OpenAI-compatible chat completions path llama.cpp's server exposes
+const DefaultChatPath = "/v1/chat/completions"
+
+// DefaultTimeout is the per-request timeout NewClient applies when the caller's context has no deadline
+const DefaultTimeout = 300 * time.Second
+
 // OpenAI-compatible message format
 type Message struct {
 	Role    string      `json:"role"`
@@ -68,24 +86,67 @@ type Usage struct {
 }
 
 func NewClient(serverURL string) (*Client, error) {
+	return NewClientWithTimeout(serverURL, DefaultTimeout)
+}
+
+// NewClientWithTimeout creates a client that bounds each request by timeout when the caller's
+// context has no deadline; 0 adds no default and respects only the caller's context
+func NewClientWithTimeout(serverURL string, timeout time.Duration) (*Client, error) {
 	if serverURL == "" {
 		serverURL = "http://localhost:8080"
 	}
 
 	return &Client{
-		baseURL: strings.TrimSuffix(serverURL, "/"),
-		httpClient: &http.Client{
-			Timeout: 5 * time.Minute,
-		},
+		baseURL:    strings.TrimSuffix(serverURL, "/"),
+		httpClient: &http.Client{},
+		timeout:    timeout,
+		chatPath:   DefaultChatPath,
 	}, nil
 }
 
-func (c *Client) SimpleQuery(ctx context.Context, model, prompt, imgB64 string) (string, error) {
-	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, 300*time.Second)
-		defer cancel()
+// SetChatPath overrides the chat completions path (default DefaultChatPath), e.g.
+// "/api/v1/chat/completions" for a gateway that mounts the API under a prefix.
+// The path must be absolute and form a valid URL with the server URL.
+func (c *Client) SetChatPath(path string) error {
+	if path == "" {
+		path = DefaultChatPath
+	}
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return fmt.Errorf("chat path %q must start with a single /", path)
+	}
+	u, err := url.Parse(c.baseURL + path)
+	if err != nil {
+		return fmt.Errorf("invalid chat path %q: %v", path, err)
 	}
+	if u.Scheme == "" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("chat path %q does not form a valid endpoint URL with %q", path, c.baseURL)
+	}
+	c.chatPath = path
+	return nil
+}
+
+// withDefaultTimeout bounds ctx by the client's timeout unless it already has a deadline
+func (c *Client) withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline || c.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// SetMaxConcurrent limits how many requests the client has in flight at once;
+// further calls wait for a free slot or for their context to end. n <= 0 removes the limit.
+// It must be called before the client is used.
+func (c *Client) SetMaxConcurrent(n int) {
+	if n <= 0 {
+		c.sem = nil
+		return
+	}
+	c.sem = make(chan struct{}, n)
+}
+
+func (c *Client) SimpleQuery(ctx context.Context, model, prompt, imgB64 string) (string, error) {
+	ctx, cancel := c.withDefaultTimeout(ctx)
+	defer cancel()
 
 	content := []ContentPart{
 		{
@@ -117,7 +178,7 @@ func (c *Client) SimpleQuery(ctx context.Context, model, prompt, imgB64 string)
 		Stream:      false,
 	}
 
-	respBody, err := c.sendRequest(ctx, "/v1/chat/completions", req)
+	respBody, err := c.sendRequest(ctx, c.chatPath, req)
 	if err != nil {
 		return "", fmt.Errorf("request failed: %v", err)
 	}
@@ -149,11 +210,8 @@ func (c *Client) SimpleQuery(ctx context.Context, model, prompt, imgB64 string)
 }
 
 func (c *Client) AnalyzeImage(ctx context.Context, model, prompt, imgB64 string) (*types.AnalysisResult, error) {
-	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, 300*time.Second)
-		defer cancel()
-	}
+	ctx, cancel := c.withDefaultTimeout(ctx)
+	defer cancel()
 
 	content := []ContentPart{
 		{
@@ -185,7 +243,7 @@ func (c *Client) AnalyzeImage(ctx context.Context, model, prompt, imgB64 string)
 		Stream:      false,
 	}
 
-	respBody, err := c.sendRequest(ctx, "/v1/chat/completions", req)
+	respBody, err := c.sendRequest(ctx, c.chatPath, req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %v", err)
 	}
@@ -222,7 +280,29 @@ func (c *Client) AnalyzeImage(ctx context.Context, model, prompt, imgB64 string)
 	return parseAnalysisResult(responseText)
 }
 
-func (c *Client) sendRequest(ctx context.Context, endpoint string, payload interface{}) ([]byte, error) {
+func (c *Client) sendRequest(ctx context.Context, endpoint string, payload interface{}) (body []byte, err error) {
+	ctx, span := tracer.Start(ctx, "llamacpp.sendRequest", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", "POST"),
+			attribute.String("url.full", c.baseURL+endpoint),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for a request slot: %v", ctx.Err())
+		}
+	}
+
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %v", err)
@@ -241,7 +321,9 @@ func (c *Client) sendRequest(ctx context.Context, endpoint string, payload inter
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	body, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response: %v", err)
 	}
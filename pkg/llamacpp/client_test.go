@@ -0,0 +1,96 @@
+package llamacpp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedTransport holds every request until release is closed and records the peak number in flight
+type gatedTransport struct {
+	body    string
+	entered chan struct{}
+	release chan struct{}
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func newGatedTransport(body string) *gatedTransport {
+	return &gatedTransport{body: body, entered: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (g *gatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	g.mu.Lock()
+	g.inFlight++
+	if g.inFlight > g.peak {
+		g.peak = g.inFlight
+	}
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.inFlight--
+		g.mu.Unlock()
+	}()
+	g.entered <- struct{}{}
+	select {
+	case <-g.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(g.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	gate := newGatedTransport(`{"choices":[{"index":0,"message":{"role":"assistant","content":"a dog"}}]}`)
+	c, err := NewClient("http://llama.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.httpClient = &http.Client{Transport: gate}
+	c.SetMaxConcurrent(2)
+
+	const calls = 5
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func() {
+			_, err := c.SimpleQuery(context.Background(), "m", "what is this?", "")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		<-gate.entered
+	}
+	select {
+	case <-gate.entered:
+		t.Fatal("a third request reached the server while two were in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A caller whose context ends while waiting for a slot gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.SimpleQuery(ctx, "m", "what is this?", ""); err == nil || !strings.Contains(err.Error(), "request slot") {
+		t.Errorf("waiting caller: got %v, want a request slot error", err)
+	}
+
+	close(gate.release)
+	for i := 0; i < calls; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if gate.peak != 2 {
+		t.Errorf("peak of %d requests in flight, want 2", gate.peak)
+	}
+}
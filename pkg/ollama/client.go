@@ -12,16 +12,53 @@ import (
 	"time"
 
 	"github.com/ollama/ollama/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/menta2k/image-analyzer/pkg/types"
 )
 
+// tracer records spans for server calls; it is a no-op unless an OpenTelemetry provider is installed
+var tracer = otel.Tracer("github.com/menta2k/image-analyzer/pkg/ollama")
+
 // Client wraps the Ollama API client
 type Client struct {
 	client *api.Client
+	sem    chan struct{} // limits in-flight chat requests, nil = unlimited
+
+	// Options are extra model options (e.g. seed, num_gpu) sent with every request;
+	// they override the built-in model-specific defaults
+	Options map[string]any
+	// KeepAlive is how long the server keeps the model loaded after a request, 0 = server default
+	KeepAlive time.Duration
+
+	timeout time.Duration // applied when the caller's context has no deadline, 0 = none
 }
 
-// NewClient creates a new Ollama client
+// DefaultTimeout is the per-request timeout NewClient applies when the caller's context has no deadline
+const DefaultTimeout = 300 * time.Second // 5 minutes for CPU processing
+
+// SetMaxConcurrent limits how many chat requests the client has in flight at once;
+// further calls wait for a free slot or for their context to end. n <= 0 removes the limit.
+// It must be called before the client is used.
+func (c *Client) SetMaxConcurrent(n int) {
+	if n <= 0 {
+		c.sem = nil
+		return
+	}
+	c.sem = make(chan struct{}, n)
+}
+
+// NewClient creates a new Ollama client with DefaultTimeout
 func NewClient(ollamaURL string) (*Client, error) {
+	return NewClientWithTimeout(ollamaURL, DefaultTimeout)
+}
+
+// NewClientWithTimeout creates a new Ollama client that bounds each request by timeout when the
+// caller's context has no deadline; 0 adds no default and respects only the caller's context
+func NewClientWithTimeout(ollamaURL string, timeout time.Duration) (*Client, error) {
 	// Parse the provided URL
 	parsedURL, err := url.Parse(ollamaURL)
 	if err != nil {
@@ -37,17 +74,22 @@ func NewClient(ollamaURL string) (*Client, error) {
 	// Create client with the specified URL, ignoring environment
 	client := api.NewClient(baseURL, http.DefaultClient)
 
-	return &Client{client: client}, nil
+	return &Client{client: client, timeout: timeout}, nil
+}
+
+// withDefaultTimeout bounds ctx by the client's timeout unless it already has a deadline
+func (c *Client) withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline || c.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.timeout)
 }
 
 // SimpleQuery performs a simple query with an image without expecting JSON
 func (c *Client) SimpleQuery(ctx context.Context, model, prompt, imgB64 string) (string, error) {
-	// Add timeout if context doesn't have one (longer for MiniCPM-V 4.5 on CPU)
-	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, 300*time.Second) // 5 minutes for CPU processing
-		defer cancel()
-	}
+	// Add the default timeout if context doesn't have one (long for MiniCPM-V 4.5 on CPU)
+	ctx, cancel := c.withDefaultTimeout(ctx)
+	defer cancel()
 
 	// Decode base64 image to raw bytes
 	imgBytes, err := base64.StdEncoding.DecodeString(imgB64)
@@ -66,30 +108,19 @@ func (c *Client) SimpleQuery(ctx context.Context, model, prompt, imgB64 string)
 				Images:  []api.ImageData{api.ImageData(imgBytes)},
 			},
 		},
-		Stream: &streamFalse,
+		Stream:  &streamFalse,
+		Options: c.mergeOptions(nil),
 		// No Format field - let it return natural language
 	}
 
-	var responseContent string
-	err = c.client.Chat(ctx, req, func(resp api.ChatResponse) error {
-		responseContent = resp.Message.Content
-		return nil
-	})
-	if err != nil {
-		return "", fmt.Errorf("ollama chat error: %v", err)
-	}
-
-	return responseContent, nil
+	return c.chat(ctx, req)
 }
 
 // AnalyzeImage analyzes an image and returns the detected subject information
 func (c *Client) AnalyzeImage(ctx context.Context, model, prompt, imgB64 string) (*types.AnalysisResult, error) {
-	// Add timeout if context doesn't have one (longer for MiniCPM-V 4.5 on CPU)
-	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, 300*time.Second) // 5 minutes for CPU processing
-		defer cancel()
-	}
+	// Add the default timeout if context doesn't have one (long for MiniCPM-V 4.5 on CPU)
+	ctx, cancel := c.withDefaultTimeout(ctx)
+	defer cancel()
 
 	// Decode base64 image to raw bytes
 	imgBytes, err := base64.StdEncoding.DecodeString(imgB64)
@@ -123,17 +154,13 @@ func (c *Client) AnalyzeImage(ctx context.Context, model, prompt, imgB64 string)
 			},
 		},
 		Stream:  &streamFalse,
-		Options: options,
+		Options: c.mergeOptions(options),
 		// No Format field - let the prompt guide the format
 	}
 
-	var responseContent string
-	err = c.client.Chat(ctx, req, func(resp api.ChatResponse) error {
-		responseContent = resp.Message.Content
-		return nil
-	})
+	responseContent, err := c.chat(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("ollama chat error: %v", err)
+		return nil, err
 	}
 
 	if responseContent == "" {
@@ -144,6 +171,55 @@ func (c *Client) AnalyzeImage(ctx context.Context, model, prompt, imgB64 string)
 	return parseAnalysisResult(responseContent)
 }
 
+// mergeOptions overlays the client's Options on top of the given defaults
+func (c *Client) mergeOptions(defaults map[string]any) map[string]any {
+	if len(c.Options) == 0 {
+		return defaults
+	}
+	merged := make(map[string]any, len(defaults)+len(c.Options))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range c.Options {
+		merged[k] = v
+	}
+	return merged
+}
+
+// chat sends a non-streaming chat request and returns the response content
+func (c *Client) chat(ctx context.Context, req *api.ChatRequest) (string, error) {
+	if c.KeepAlive != 0 {
+		req.KeepAlive = &api.Duration{Duration: c.KeepAlive}
+	}
+
+	ctx, span := tracer.Start(ctx, "ollama.chat", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("model", req.Model)))
+	defer span.End()
+
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		case <-ctx.Done():
+			span.RecordError(ctx.Err())
+			span.SetStatus(codes.Error, ctx.Err().Error())
+			return "", fmt.Errorf("ollama chat error: %v", ctx.Err())
+		}
+	}
+
+	var responseContent string
+	err := c.client.Chat(ctx, req, func(resp api.ChatResponse) error {
+		responseContent = resp.Message.Content
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", fmt.Errorf("ollama chat error: %v", err)
+	}
+	return responseContent, nil
+}
+
 // parseAnalysisResult parses the JSON response from the vision model
 func parseAnalysisResult(raw string) (*types.AnalysisResult, error) {
 	raw = sanitizeModelJSON(raw)
@@ -0,0 +1,141 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// gatedTransport holds every request until release is closed and records the peak number in flight
+type gatedTransport struct {
+	body    string
+	entered chan struct{}
+	release chan struct{}
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func newGatedTransport(body string) *gatedTransport {
+	return &gatedTransport{body: body, entered: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (g *gatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	g.mu.Lock()
+	g.inFlight++
+	if g.inFlight > g.peak {
+		g.peak = g.inFlight
+	}
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.inFlight--
+		g.mu.Unlock()
+	}()
+	g.entered <- struct{}{}
+	select {
+	case <-g.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/x-ndjson"}},
+		Body:       io.NopCloser(strings.NewReader(g.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	gate := newGatedTransport(`{"model":"m","message":{"role":"assistant","content":"a dog"},"done":true}` + "\n")
+	c, err := NewClient("http://ollama.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.client = api.NewClient(&url.URL{Scheme: "http", Host: "ollama.test"}, &http.Client{Transport: gate})
+	c.SetMaxConcurrent(2)
+
+	const calls = 5
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func() {
+			_, err := c.SimpleQuery(context.Background(), "m", "what is this?", "aW1n")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		<-gate.entered
+	}
+	select {
+	case <-gate.entered:
+		t.Fatal("a third request reached the server while two were in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A caller whose context ends while waiting for a slot gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.SimpleQuery(ctx, "m", "what is this?", "aW1n"); err == nil {
+		t.Error("a caller waiting past its deadline succeeded")
+	}
+
+	close(gate.release)
+	for i := 0; i < calls; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if gate.peak != 2 {
+		t.Errorf("peak of %d requests in flight, want 2", gate.peak)
+	}
+}
+
+func TestOptionsAndKeepAlive(t *testing.T) {
+	var got api.ChatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = api.ChatRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("request body: %v", err)
+		}
+		fmt.Fprintf(w, `{"model":"m","message":{"role":"assistant","content":%q},"done":true}`+"\n",
+			`{"primary":{"label":"dog","confidence":0.9,"box":{"x":0.3,"y":0.3,"w":0.4,"h":0.4},"cx":0.5,"cy":0.5},"description":"a dog","tags":["dog"]}`)
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Options = map[string]any{"seed": 42, "temperature": 0.1}
+	c.KeepAlive = 10 * time.Minute
+	if _, err := c.AnalyzeImage(context.Background(), "minicpm-v4.5", "find the subject", "aW1n"); err != nil {
+		t.Fatal(err)
+	}
+	// Client options override the model defaults, which are otherwise kept
+	if got.Options["seed"] != float64(42) || got.Options["temperature"] != 0.1 || got.Options["num_ctx"] != float64(4096) {
+		t.Errorf("options %v, want seed 42, temperature 0.1 and the default num_ctx", got.Options)
+	}
+	if got.KeepAlive == nil || got.KeepAlive.Duration != 10*time.Minute {
+		t.Errorf("keep_alive %v, want 10m", got.KeepAlive)
+	}
+
+	// Without them the request carries neither
+	c.Options, c.KeepAlive = nil, 0
+	if _, err := c.SimpleQuery(context.Background(), "m", "what is this?", "aW1n"); err != nil {
+		t.Fatal(err)
+	}
+	if got.KeepAlive != nil || got.Options["seed"] != nil {
+		t.Errorf("defaults sent keep_alive %v and options %v", got.KeepAlive, got.Options)
+	}
+}
@@ -3,32 +3,244 @@ package processing
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"log"
 	"math"
+	"math/bits"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
 	_ "golang.org/x/image/webp"
 
 	"github.com/menta2k/image-analyzer/pkg/types"
 )
 
 // Processor handles image processing operations
-type Processor struct{}
+type Processor struct {
+	// SVGSize is the longest side (px) SVG inputs are rasterized to, 0 = intrinsic size
+	SVGSize int
+	// AllowPartial returns the decoded part of truncated JPEGs (rest filled gray) instead of failing
+	AllowPartial bool
+	// AllowThumbnailOnly upscales JPEGs of which only the EXIF thumbnail decodes to their declared
+	// size, within MaxPixels (with a warning), instead of failing with ErrThumbnailOnly
+	AllowThumbnailOnly bool
+	// FlattenBackground fills transparent areas when encoding to a format without alpha (JPEG)
+	FlattenBackground color.Color
+	// PadColor fills the bars added by FitAndPad and Fit(Contain), nil = FlattenBackground
+	PadColor color.Color
+	// HTTPTimeout bounds each LoadImageFromURL download, 0 = DefaultHTTPTimeout
+	HTTPTimeout time.Duration
+	// PNGColorType forces the color type and bit depth of encoded PNGs, "" = keep the source's
+	PNGColorType PNGColorType
+	// TagSRGB marks encoded JPEGs (embedded sRGB ICC profile) and PNGs (sRGB chunk) as sRGB
+	TagSRGB bool
+	// AllowedHosts restricts LoadImageFromURL to these hosts (redirects included); an entry
+	// starting with "." also allows its subdomains. Empty allows every host.
+	AllowedHosts []string
+	// BlockPrivateNetworks makes LoadImageFromURL refuse loopback, private, link-local and other
+	// non-public addresses, checked on the resolved IP of every connection (proxies are bypassed)
+	BlockPrivateNetworks bool
+	// MaxPixels caps the pixel count of decoded inputs (larger raster images fail with
+	// ErrImageTooLarge, SVGs are rasterized smaller), 0 = DefaultMaxPixels
+	MaxPixels int64
+	// PoolBuffers reuses same-size intermediate NRGBA buffers (see Release) to reduce GC pressure
+	PoolBuffers bool
+
+	pools sync.Map // image.Point size -> *sync.Pool of *image.NRGBA
+}
+
+// ErrBlockedHost is returned (wrapped) when LoadImageFromURL refuses a host or address
+var ErrBlockedHost = errors.New("blocked host")
+
+// checkHost applies AllowedHosts to a URL's host
+func (p *Processor) checkHost(u *url.URL) error {
+	if len(p.AllowedHosts) == 0 {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if host == strings.TrimPrefix(allowed, ".") ||
+			(strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not in the allowed hosts", ErrBlockedHost, host)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), not covered by netip.IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// checkDialAddress rejects connections to non-public addresses for BlockPrivateNetworks
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: cannot parse address %s", ErrBlockedHost, address)
+	}
+	ip := ap.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %s is not a public address", ErrBlockedHost, ip)
+	}
+	return nil
+}
+
+// PNGColorType is a PNG color type and bit depth that EncodeImage converts to
+type PNGColorType string
+
+const (
+	PNGColorAuto   PNGColorType = ""       // encoder picks from the image (alpha kept if present)
+	PNGColorRGB    PNGColorType = "rgb"    // 8-bit RGB, transparency flattened onto FlattenBackground
+	PNGColorRGB16  PNGColorType = "rgb16"  // 16-bit RGB, transparency flattened
+	PNGColorGray   PNGColorType = "gray"   // 8-bit grayscale (Rec. 709 luma), transparency flattened
+	PNGColorGray16 PNGColorType = "gray16" // 16-bit grayscale (Rec. 709 luma), transparency flattened
+)
+
+// ParsePNGColorType validates a PNG color type name (case-insensitive)
+func ParsePNGColorType(s string) (PNGColorType, error) {
+	switch t := PNGColorType(strings.ToLower(strings.TrimSpace(s))); t {
+	case PNGColorAuto, PNGColorRGB, PNGColorRGB16, PNGColorGray, PNGColorGray16:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown PNG color type %q (use rgb, rgb16, gray, gray16)", s)
+}
+
+// toPNGColorType converts an image to the configured PNGColorType; the standard PNG encoder
+// writes *image.RGBA/RGBA64 without alpha when opaque and *image.Gray/Gray16 as grayscale
+func (p *Processor) toPNGColorType(img image.Image) image.Image {
+	switch p.PNGColorType {
+	case PNGColorRGB:
+		flat := p.flatten(img)
+		rgb := image.NewRGBA(flat.Bounds())
+		draw.Draw(rgb, rgb.Bounds(), flat, flat.Bounds().Min, draw.Src)
+		return rgb
+	case PNGColorRGB16:
+		flat := p.flatten(img)
+		rgb := image.NewRGBA64(flat.Bounds())
+		draw.Draw(rgb, rgb.Bounds(), flat, flat.Bounds().Min, draw.Src)
+		return rgb
+	case PNGColorGray:
+		return p.ToGrayscale(p.flatten(img))
+	case PNGColorGray16:
+		flat := p.flatten(img)
+		b := flat.Bounds()
+		gray := image.NewGray16(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := flat.At(x, y).RGBA()
+				l := 0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(bl) + 0.5
+				gray.SetGray16(x, y, color.Gray16{Y: uint16(clamp(l, 0, 65535))})
+			}
+		}
+		return gray
+	}
+	return img
+}
+
+// DefaultHTTPTimeout is the download timeout used by LoadImageFromURL
+const DefaultHTTPTimeout = 30 * time.Second
 
 // NewProcessor creates a new image processor
 func NewProcessor() *Processor {
-	return &Processor{}
+	return &Processor{FlattenBackground: color.White, HTTPTimeout: DefaultHTTPTimeout}
+}
+
+// pooledNRGBA returns a w x h NRGBA image, reused from a buffer passed to Release when
+// PoolBuffers is set; the pixels of a reused buffer are stale and must be overwritten
+func (p *Processor) pooledNRGBA(w, h int) *image.NRGBA {
+	if p.PoolBuffers {
+		if pool, ok := p.pools.Load(image.Pt(w, h)); ok {
+			if img, ok := pool.(*sync.Pool).Get().(*image.NRGBA); ok {
+				return img
+			}
+		}
+	}
+	return image.NewNRGBA(image.Rect(0, 0, w, h))
+}
+
+// Release returns an image created by the processor (e.g. a debug overlay) to the buffer pool
+// for reuse by later same-size operations. It is a no-op when PoolBuffers is unset or the image
+// is not a plain NRGBA buffer. Any plain NRGBA with origin (0,0) is pooled, including one the
+// caller allocated, so only release images nothing else references: the image and any
+// SubImage sharing its pixels must not be used after Release.
+func (p *Processor) Release(img image.Image) {
+	n, ok := img.(*image.NRGBA)
+	if !p.PoolBuffers || !ok || n.Rect.Min != (image.Point{}) || n.Stride != 4*n.Rect.Dx() {
+		return
+	}
+	pool, _ := p.pools.LoadOrStore(n.Rect.Size(), &sync.Pool{})
+	pool.(*sync.Pool).Put(n)
+}
+
+// clone copies an image into an NRGBA buffer with origin (0,0), pooled when PoolBuffers is set
+func (p *Processor) clone(img image.Image) *image.NRGBA {
+	if !p.PoolBuffers {
+		return imaging.Clone(img)
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := p.pooledNRGBA(w, h)
+	switch src := img.(type) {
+	case *image.NRGBA:
+		for y := 0; y < h; y++ {
+			si := src.PixOffset(b.Min.X, b.Min.Y+y)
+			copy(dst.Pix[y*dst.Stride:y*dst.Stride+4*w], src.Pix[si:si+4*w])
+		}
+	case *image.YCbCr:
+		for y := 0; y < h; y++ {
+			di := y * dst.Stride
+			for x := 0; x < w; x++ {
+				yi := src.YOffset(b.Min.X+x, b.Min.Y+y)
+				ci := src.COffset(b.Min.X+x, b.Min.Y+y)
+				r, g, bl := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+				dst.Pix[di], dst.Pix[di+1], dst.Pix[di+2], dst.Pix[di+3] = r, g, bl, 0xff
+				di += 4
+			}
+		}
+	default:
+		draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	}
+	return dst
+}
+
+// flatten composites an image with transparency onto FlattenBackground (white if unset)
+func (p *Processor) flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	bg := p.FlattenBackground
+	if bg == nil {
+		bg = color.White
+	}
+	b := img.Bounds()
+	return imaging.Overlay(imaging.New(b.Dx(), b.Dy(), bg), img, image.Pt(0, 0), 1.0)
 }
 
 // LoadImageFromURL downloads and loads an image from a URL
@@ -43,8 +255,29 @@ func (p *Processor) LoadImageFromURL(imageURL string) (image.Image, error) {
 	}
 
 	// Create HTTP client with timeout
+	timeout := p.HTTPTimeout
+	if timeout <= 0 {
+		timeout = DefaultHTTPTimeout
+	}
 	client := &http.Client{
-		Timeout: 30 * time.Second,
+		Timeout: timeout,
+	}
+	if err := p.checkHost(parsedURL); err != nil {
+		return nil, err
+	}
+	if len(p.AllowedHosts) > 0 {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return p.checkHost(req.URL)
+		}
+	}
+	if p.BlockPrivateNetworks {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		transport.DialContext = (&net.Dialer{Timeout: timeout, Control: checkDialAddress}).DialContext
+		client.Transport = transport
 	}
 
 	// Create request with User-Agent header
@@ -57,6 +290,9 @@ func (p *Processor) LoadImageFromURL(imageURL string) (image.Image, error) {
 	// Make request
 	resp, err := client.Do(req)
 	if err != nil {
+		if errors.Is(err, ErrBlockedHost) {
+			return nil, fmt.Errorf("failed to download image: %w", err)
+		}
 		return nil, fmt.Errorf("failed to download image: %v", err)
 	}
 	defer resp.Body.Close()
@@ -82,24 +318,65 @@ func (p *Processor) LoadImageFromURL(imageURL string) (image.Image, error) {
 	return p.decodeImageFromBytes(imageData)
 }
 
-// LoadImage loads an image from a file path with WebP support
+// LoadImage loads an image from a file path with WebP and SVG support
 func (p *Processor) LoadImage(path string) (image.Image, error) {
-	// Try imaging.Open (registered decoders)
-	if img, err := imaging.Open(path); err == nil {
+	// Empty files (e.g. interrupted downloads) would otherwise fail deep in a decoder with EOF
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Size() < minImageBytes {
+		return nil, fmt.Errorf("%s: %w (%d bytes)", path, ErrEmptyFile, info.Size())
+	}
+
+	// SVG is not a registered decoder, rasterize it explicitly
+	if strings.HasSuffix(strings.ToLower(path), ".svg") {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return p.decodeSVG(f)
+	}
+
+	// Camera RAW files are decoded via their embedded JPEG preview
+	if RAWExtensions[strings.ToLower(filepath.Ext(path))] {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		img, err := decodeRAWPreview(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
 		return img, nil
 	}
 
-	// Fallback: explicit WebP decode
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
+	// Refuse files whose content is not an image before handing them to decoders
+	head := make([]byte, exifScanLen)
+	n, _ := io.ReadFull(f, head)
+	if err := checkImageContent(head[:n]); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := p.checkPixelLimit(head[:n]); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Try imaging.Open (registered decoders)
+	if img, err := imaging.Open(path); err == nil {
+		warnDeclaredSize(path, img, head[:n])
+		return img, nil
+	}
+
+	// Fallback: explicit WebP decode, from the start again after the content sniff
 	low := strings.ToLower(path)
 	if strings.HasSuffix(low, ".webp") || strings.Contains(low, ".webp") {
-		if img, err := webp.Decode(f); err == nil {
-			return img, nil
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			if img, err := webp.Decode(f); err == nil {
+				return img, nil
+			}
 		}
 		if _, err := f.Seek(0, 0); err == nil {
 			if img, _, err := image.Decode(f); err == nil {
@@ -109,11 +386,32 @@ func (p *Processor) LoadImage(path string) (image.Image, error) {
 	} else {
 		if _, err := f.Seek(0, 0); err == nil {
 			if img, _, err := image.Decode(f); err == nil {
+				warnDeclaredSize(path, img, head[:n])
 				return img, nil
 			}
 		}
 	}
-	return nil, fmt.Errorf("image: unknown format for %s", path)
+
+	// Last resort: recover what we can from a truncated JPEG
+	if p.AllowPartial {
+		if _, err := f.Seek(0, 0); err == nil {
+			if data, err := io.ReadAll(f); err == nil && isTruncatedJPEG(data) {
+				if img, err := decodePartialJPEG(data); err == nil {
+					log.Printf("warning: %s is truncated, using partially decoded image", path)
+					return img, nil
+				}
+			}
+		}
+	}
+
+	// The main image is broken, but the EXIF thumbnail (within the first 64 KiB) may survive
+	if img, ok, err := p.decodeThumbnailOnly(path, head[:n]); ok {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return img, nil
+	}
+	return nil, &UnsupportedFormatError{Format: sniffFormat(head[:n]), Path: path}
 }
 
 // LoadImageSmart loads an image from either a file path or URL
@@ -126,11 +424,88 @@ func (p *Processor) LoadImageSmart(source string) (image.Image, error) {
 	return p.LoadImage(source)
 }
 
+// LoadImageFromBytes decodes an image held in memory (jpg/png/webp/svg)
+func (p *Processor) LoadImageFromBytes(data []byte) (image.Image, error) {
+	return p.decodeImageFromBytes(data)
+}
+
+// LoadImageFromReader decodes an image from a stream (jpg/png/webp/svg). Seekable readers go
+// through LoadImageFromSeeker; others are buffered in memory so every decoder can be tried.
+func (p *Processor) LoadImageFromReader(r io.Reader) (image.Image, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return p.LoadImageFromSeeker(rs)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %v", err)
+	}
+	return p.decodeImageFromBytes(data)
+}
+
+// LoadImageFromSeeker decodes an image from a seekable source starting at its current offset.
+// The decoder is picked from the leading bytes, so raster formats (including WebP) decode
+// straight from the source; anything else falls back to the in-memory loader.
+func (p *Processor) LoadImageFromSeeker(r io.ReadSeeker) (image.Image, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seek image: %v", err)
+	}
+	head := make([]byte, exifScanLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to read image: %v", err)
+	}
+	rewind := func() error {
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek image: %v", err)
+		}
+		return nil
+	}
+	if err := rewind(); err != nil {
+		return nil, err
+	}
+	if err := p.checkPixelLimit(head[:n]); err != nil {
+		return nil, err
+	}
+
+	switch sniffFormat(head[:n]) {
+	case "unknown", "svg":
+		// Needs the whole input (SVG, content checks)
+	case "webp":
+		if img, err := webp.Decode(r); err == nil {
+			return img, nil
+		}
+	default:
+		if img, _, err := image.Decode(r); err == nil {
+			warnDeclaredSize("image data", img, head[:n])
+			return img, nil
+		}
+	}
+
+	// Let the in-memory loader try every decoder and report the error
+	if err := rewind(); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %v", err)
+	}
+	return p.decodeImageFromBytes(data)
+}
+
 // decodeImageFromBytes decodes an image from byte data with WebP support
 func (p *Processor) decodeImageFromBytes(data []byte) (image.Image, error) {
+	if err := checkImageContent(data); err != nil {
+		return nil, err
+	}
+	if err := p.checkPixelLimit(data); err != nil {
+		return nil, err
+	}
+
 	// Try standard image.Decode first
 	reader := bytes.NewReader(data)
 	if img, _, err := image.Decode(reader); err == nil {
+		warnDeclaredSize("image data", img, data)
 		return img, nil
 	}
 
@@ -140,167 +515,2354 @@ func (p *Processor) decodeImageFromBytes(data []byte) (image.Image, error) {
 		return img, nil
 	}
 
-	return nil, fmt.Errorf("image: unknown or unsupported format")
-}
-
-// PrepareImageForModel converts an image to base64 for sending to vision models
-func (p *Processor) PrepareImageForModel(img image.Image, format string, maxDim int, quality int) (string, error) {
-	if maxDim > 0 {
-		b := img.Bounds()
-		w, h := b.Dx(), b.Dy()
-		if w > maxDim || h > maxDim {
-			if w >= h {
-				img = imaging.Resize(img, maxDim, 0, imaging.Lanczos)
-			} else {
-				img = imaging.Resize(img, 0, maxDim, imaging.Lanczos)
-			}
-		}
+	// Try SVG rasterization
+	if isSVG(data) {
+		return p.decodeSVG(bytes.NewReader(data))
 	}
 
-	var buf bytes.Buffer
-	switch strings.ToLower(format) {
-	case "png":
-		enc := png.Encoder{CompressionLevel: png.BestCompression}
-		if err := enc.Encode(&buf, img); err != nil {
-			return "", err
-		}
-	default: // jpg
-		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
-			return "", err
+	// Last resort: recover what we can from a truncated JPEG
+	if p.AllowPartial && isTruncatedJPEG(data) {
+		if img, err := decodePartialJPEG(data); err == nil {
+			log.Printf("warning: image data is truncated, using partially decoded image")
+			return img, nil
 		}
 	}
-	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
-}
-
-// CropImageToBox crops an image to the specified normalized box
-func (p *Processor) CropImageToBox(img image.Image, box types.Box, targetWidth, targetHeight int) (image.Image, error) {
-	bounds := img.Bounds()
-	fw, fh := float64(bounds.Dx()), float64(bounds.Dy())
-
-	// Convert normalized box to pixel coordinates
-	x0 := int(clamp(box.X, 0, 1)*fw + 0.5)
-	y0 := int(clamp(box.Y, 0, 1)*fh + 0.5)
-	x1 := int(clamp(box.X+box.W, 0, 1)*fw + 0.5)
-	y1 := int(clamp(box.Y+box.H, 0, 1)*fh + 0.5)
 
-	rect := image.Rect(x0, y0, x1, y1).Intersect(bounds)
-	if rect.Empty() {
-		return nil, fmt.Errorf("empty crop rectangle")
+	// The main image is broken, but the EXIF thumbnail may survive
+	if img, ok, err := p.decodeThumbnailOnly("image data", data); ok {
+		return img, err
 	}
 
-	cropped := imaging.Crop(img, rect)
+	return nil, &UnsupportedFormatError{Format: sniffFormat(data)}
+}
 
-	// Resize to exact target dimensions while preserving aspect ratio
-	if targetWidth > 0 && targetHeight > 0 {
-		cropped = imaging.Fill(cropped, targetWidth, targetHeight, imaging.Center, imaging.Lanczos)
-	}
+var (
+	inputFormatsOnce sync.Once
+	inputFormats     []string
+)
 
-	return cropped, nil
+// SupportedInputFormats lists the image formats the loaders can decode in this build.
+// Raster formats are probed by round-tripping a tiny image through the registered decoders.
+func SupportedInputFormats() []string {
+	inputFormatsOnce.Do(func() {
+		probe := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+		for _, f := range []struct {
+			name   string
+			format imaging.Format
+		}{{"jpg", imaging.JPEG}, {"png", imaging.PNG}, {"gif", imaging.GIF}, {"bmp", imaging.BMP}, {"tiff", imaging.TIFF}} {
+			var buf bytes.Buffer
+			if imaging.Encode(&buf, probe, f.format) != nil {
+				continue
+			}
+			if _, _, err := image.DecodeConfig(&buf); err == nil {
+				inputFormats = append(inputFormats, f.name)
+			}
+		}
+		var buf bytes.Buffer
+		if webp.Encode(&buf, probe, &webp.Options{Lossless: true}) == nil {
+			if _, err := webp.Decode(&buf); err == nil {
+				inputFormats = append(inputFormats, "webp")
+			}
+		}
+		// A registered AVIF backend may also register a decoder with the image package
+		if AVIFAvailable() {
+			buf.Reset()
+			if avifEncoder(&buf, probe, 90) == nil {
+				if _, _, err := image.DecodeConfig(&buf); err == nil {
+					inputFormats = append(inputFormats, "avif")
+				}
+			}
+		}
+		inputFormats = append(inputFormats, "svg")
+	})
+	return append([]string(nil), inputFormats...)
 }
 
-// CalculateOptimalCropBox calculates the optimal crop box for given aspect ratio centered at a point
-func (p *Processor) CalculateOptimalCropBox(centerX, centerY float64, targetWidth, targetHeight, imgWidth, imgHeight int, zoom float64) types.Box {
-	if zoom <= 0 {
-		zoom = 1
+// SupportedOutputFormats lists the formats EncodeImage and SaveImage can write
+func SupportedOutputFormats() []string {
+	formats := []string{"jpg", "png", "webp"}
+	if AVIFAvailable() {
+		formats = append(formats, "avif")
 	}
+	return formats
+}
 
-	r := float64(targetWidth) / float64(targetHeight) // target aspect W/H
-
-	// Center in pixels
-	cx := centerX * float64(imgWidth)
-	cy := centerY * float64(imgHeight)
+// AVIFEncodeFunc encodes img as AVIF at the given quality (1-100)
+type AVIFEncodeFunc func(w io.Writer, img image.Image, quality int) error
 
-	// Max half extents allowed by image bounds
-	halfWMax := math.Min(cx, float64(imgWidth)-cx)
-	halfHMax := math.Min(cy, float64(imgHeight)-cy)
+// avifEncoder backs "avif" output; nil until a backend calls RegisterAVIFEncoder
+var avifEncoder AVIFEncodeFunc
 
-	// Width is limited by horizontal bounds AND by vertical bounds scaled by aspect
-	maxWidthPx := math.Min(2*halfWMax, r*(2*halfHMax))
-	widthPx := maxWidthPx * clamp(zoom, 0.01, 1.0)
-	heightPx := widthPx / r
+// ErrAVIFUnavailable is returned when avif output is requested but no encoder is registered
+var ErrAVIFUnavailable = errors.New("avif output is not available in this build (no AVIF encoder registered)")
 
-	// Top-left in pixels, clamped
-	x0 := clamp(cx-widthPx/2, 0, float64(imgWidth)-widthPx)
-	y0 := clamp(cy-heightPx/2, 0, float64(imgHeight)-heightPx)
+// RegisterAVIFEncoder installs the encoder used for "avif" output. AVIF needs a native
+// codec (libavif/libaom), so it is provided by the embedding program rather than built in.
+// It must be called before any images are encoded.
+func RegisterAVIFEncoder(enc AVIFEncodeFunc) {
+	avifEncoder = enc
+}
 
-	return types.Box{
-		X: x0 / float64(imgWidth),
-		Y: y0 / float64(imgHeight),
-		W: widthPx / float64(imgWidth),
-		H: heightPx / float64(imgHeight),
-	}
+// AVIFAvailable reports whether an AVIF encoder is registered
+func AVIFAvailable() bool {
+	return avifEncoder != nil
 }
 
-// FindNearestPointToCenter finds the nearest point in a box to the image center
-func (p *Processor) FindNearestPointToCenter(box types.Box) (float64, float64) {
-	cx := clamp(0.5, box.X, box.X+box.W)
-	cy := clamp(0.5, box.Y, box.Y+box.H)
-	return cx, cy
+// RAWExtensions are camera RAW file extensions LoadImage reads through their embedded JPEG preview
+var RAWExtensions = map[string]bool{
+	".cr2": true,
+	".cr3": true,
+	".nef": true,
+	".arw": true,
+	".dng": true,
+	".raf": true,
+	".orf": true,
+	".rw2": true,
+	".pef": true,
 }
 
-// SaveImage saves an image to a file with the specified format and quality
-func (p *Processor) SaveImage(img image.Image, path, format string, quality int, lossless bool) error {
-	switch strings.ToLower(format) {
-	case "webp":
-		f, err := os.Create(path)
-		if err != nil {
-			return err
+// decodeRAWPreview decodes the largest baseline/progressive JPEG embedded in a RAW file
+func decodeRAWPreview(data []byte) (image.Image, error) {
+	soi := []byte{0xff, 0xd8, 0xff}
+	best, bestArea := -1, 0
+	for off := 0; ; {
+		i := bytes.Index(data[off:], soi)
+		if i < 0 {
+			break
 		}
-		defer f.Close()
-		opts := &webp.Options{Lossless: lossless, Quality: float32(quality)}
-		return webp.Encode(f, img, opts)
-	case "png":
-		return imaging.Save(img, path)
-	default: // jpg/jpeg
-		return imaging.Save(img, path, imaging.JPEGQuality(quality))
+		off += i
+		// Lossless JPEG sensor data and other unsupported streams fail here and are skipped
+		if cfg, err := jpeg.DecodeConfig(bytes.NewReader(data[off:])); err == nil && cfg.Width*cfg.Height > bestArea {
+			best, bestArea = off, cfg.Width*cfg.Height
+		}
+		off += len(soi)
+	}
+	if best < 0 {
+		return nil, fmt.Errorf("no embedded JPEG preview found in RAW file")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data[best:]))
+	if err != nil {
+		return nil, fmt.Errorf("embedded JPEG preview: %v", err)
 	}
+	return img, nil
 }
 
-// CreateDebugOverlay creates an overlay image showing detection and crop boxes
-func (p *Processor) CreateDebugOverlay(img image.Image, modelBox, cropBox types.Box, cropCx, cropCy float64) image.Image {
-	nrgba := imaging.Clone(img)
-	w := nrgba.Bounds().Dx()
-	h := nrgba.Bounds().Dy()
+// ErrNotImage is returned (wrapped) when input content is not an image, e.g. HTML or an archive
+var ErrNotImage = errors.New("content is not an image")
 
-	// Colors
-	green := color.NRGBA{0, 255, 0, 255}                  // model box
-	gold := color.NRGBA{255, 204, 0, 255}                 // crop box
-	red := color.NRGBA{255, 0, 0, 255}                    // crop center
-	blue := color.NRGBA{0, 170, 255, 255}                 // image center
-	stroke := int(math.Max(2, 0.004*float64(minInt(w, h)))) // ~0.4% of min side
-	cross := int(math.Max(4, 0.01*float64(minInt(w, h))))   // ~1% of min side
+// ErrEmptyFile is returned (wrapped) when input is empty or too short to hold any image
+var ErrEmptyFile = errors.New("empty or truncated image file")
 
-	// Draw model box
-	drawBox(nrgba, modelBox, w, h, green, stroke)
+// ErrThumbnailOnly is returned (wrapped) when the main image of a JPEG does not decode but the
+// thumbnail embedded in its EXIF data does, i.e. only the thumbnail survived
+var ErrThumbnailOnly = errors.New("main image is missing, only the EXIF thumbnail decoded")
 
-	// Draw crop box if valid
-	if cropBox.W > 0 && cropBox.H > 0 {
-		drawBox(nrgba, cropBox, w, h, gold, stroke)
-	}
+// ErrImageTooLarge is returned (wrapped) for raster inputs with more pixels than the processor's limit
+var ErrImageTooLarge = errors.New("image exceeds the pixel limit")
 
-	// Draw crop center crosshair
-	px := int(clamp(cropCx, 0, 1)*float64(w) + 0.5)
-	py := int(clamp(cropCy, 0, 1)*float64(h) + 0.5)
-	drawHLine(nrgba, py, px-cross, px+cross, red)
-	drawVLine(nrgba, px, py-cross, py+cross, red)
+// DefaultMaxPixels is the pixel limit used when Processor.MaxPixels is 0 (about 1 GiB as NRGBA)
+const DefaultMaxPixels = 1 << 28
 
-	// Draw image center marker
-	ix, iy := w/2, h/2
-	drawHLine(nrgba, iy, ix-6, ix+6, blue)
-	drawVLine(nrgba, ix, iy-6, iy+6, blue)
+// minImageBytes is the shortest input that can be an image (a PNG signature alone is 8 bytes)
+const minImageBytes = 8
 
-	return nrgba
+// maxPixels returns the pixel limit for decoded and rasterized images
+func (p *Processor) maxPixels() int64 {
+	if p.MaxPixels > 0 {
+		return p.MaxPixels
+	}
+	return DefaultMaxPixels
 }
 
-// Helper functions
-func clamp(v, lo, hi float64) float64 {
-	if v < lo {
-		return lo
+// checkPixelLimit rejects raster data whose header declares more pixels than the limit;
+// data whose header cannot be read is left to the decoders
+func (p *Processor) checkPixelLimit(data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
 	}
-	if v > hi {
-		return hi
+	if int64(cfg.Width)*int64(cfg.Height) > p.maxPixels() {
+		return fmt.Errorf("%w (%dx%d)", ErrImageTooLarge, cfg.Width, cfg.Height)
 	}
-	return v
+	return nil
+}
+
+// checkImageContent rejects data that is too short to be an image or whose leading bytes
+// identify it as something other than an image
+func checkImageContent(data []byte) error {
+	if len(data) < minImageBytes {
+		return fmt.Errorf("%w (%d bytes)", ErrEmptyFile, len(data))
+	}
+	if sniffFormat(data) != "unknown" {
+		return nil
+	}
+	head := data
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	if ct := http.DetectContentType(head); !strings.HasPrefix(ct, "image/") {
+		return fmt.Errorf("%w (detected %s)", ErrNotImage, ct)
+	}
+	return nil
+}
+
+// UnsupportedFormatError is returned when image data cannot be decoded by any available decoder
+type UnsupportedFormatError struct {
+	Format string // format guessed from the leading bytes, "unknown" if unrecognized
+	Path   string // source file, empty for in-memory data
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("image: unknown format for %s", e.Path)
+	}
+	return "image: unknown or unsupported format"
+}
+
+// sniffLen is how many leading bytes sniffFormat looks at
+const sniffLen = 512
+
+// sniffFormat guesses an image format from its magic bytes
+func sniffFormat(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		return "jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return "gif"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return "bmp"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return "tiff"
+	case bytes.HasPrefix(data, []byte("8BPS")):
+		return "psd"
+	case bytes.HasPrefix(data, []byte("\x00\x00\x01\x00")):
+		return "ico"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		switch string(data[8:12]) {
+		case "avif", "avis":
+			return "avif"
+		case "heic", "heix", "hevc", "mif1", "msf1":
+			return "heic"
+		}
+	case isSVG(data):
+		return "svg"
+	}
+	return "unknown"
+}
+
+// isSVG reports whether data starts an SVG document: after an optional BOM, whitespace, XML
+// declaration, comments and doctype, the first element must be <svg. An <svg inside an HTML
+// page does not count.
+func isSVG(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	for {
+		data = bytes.TrimLeft(data, " \t\r\n")
+		end := -1
+		switch {
+		case bytes.HasPrefix(data, []byte("<?")):
+			if i := bytes.Index(data, []byte("?>")); i >= 0 {
+				end = i + 2
+			}
+		case bytes.HasPrefix(data, []byte("<!--")):
+			if i := bytes.Index(data, []byte("-->")); i >= 0 {
+				end = i + 3
+			}
+		case bytes.HasPrefix(bytes.ToUpper(data[:minInt(len(data), 9)]), []byte("<!DOCTYPE")):
+			// Skip an internal subset in brackets before looking for the closing >
+			from := 0
+			if i := bytes.IndexAny(data, "[>"); i >= 0 && data[i] == '[' {
+				if from = bytes.IndexByte(data, ']'); from < 0 {
+					return false
+				}
+			}
+			if i := bytes.IndexByte(data[from:], '>'); i >= 0 {
+				end = from + i + 1
+			}
+		default:
+			return bytes.HasPrefix(data, []byte("<svg"))
+		}
+		if end < 0 {
+			return false
+		}
+		data = data[end:]
+	}
+}
+
+// exifScanLen is how many leading bytes are searched for EXIF data (an APP1 segment is at most 64 KiB)
+const exifScanLen = 128 << 10
+
+// Stale EXIF size warning: a JPEG whose decoded longest edge is at most staleSizeMaxEdge and at
+// least staleSizeFactor times smaller than its EXIF PixelXDimension/PixelYDimension
+const (
+	staleSizeMaxEdge = 512
+	staleSizeFactor  = 4
+	maxDeclaredEdge  = 1 << 15 // larger EXIF dimensions are treated as bogus
+)
+
+// warnDeclaredSize logs a warning when a decoded JPEG is far smaller than the dimensions in its
+// EXIF data (head holds the start of the file). The image decoded fine, so this is usually EXIF
+// left stale by a resize rather than damage.
+func warnDeclaredSize(name string, img image.Image, head []byte) {
+	t, ok := exifTIFF(head)
+	if !ok {
+		return
+	}
+	declW, declH, ok := tiffPixelDimensions(t)
+	if !ok || declW > maxDeclaredEdge || declH > maxDeclaredEdge {
+		return
+	}
+	b := img.Bounds()
+	edge := maxInt(b.Dx(), b.Dy())
+	if edge > staleSizeMaxEdge || edge*staleSizeFactor > maxInt(declW, declH) {
+		return
+	}
+	log.Printf("warning: %s decoded to %dx%d but its EXIF declares %dx%d", name, b.Dx(), b.Dy(), declW, declH)
+}
+
+// decodeThumbnailOnly is tried after the main image of data failed to decode (head holds the start
+// of the file). ok reports whether the EXIF data embeds a thumbnail that decodes; if so the result
+// is ErrThumbnailOnly, or with AllowThumbnailOnly the thumbnail upscaled to the declared size
+// (kept within the pixel limit) with a warning.
+func (p *Processor) decodeThumbnailOnly(name string, head []byte) (img image.Image, ok bool, err error) {
+	t, ok := exifTIFF(head)
+	if !ok {
+		return nil, false, nil
+	}
+	thumb, ok := tiffThumbnail(t)
+	if !ok {
+		return nil, false, nil
+	}
+	img, err = jpeg.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		return nil, false, nil
+	}
+	b := img.Bounds()
+	if !p.AllowThumbnailOnly {
+		return nil, true, fmt.Errorf("main image does not decode, EXIF thumbnail is %dx%d: %w", b.Dx(), b.Dy(), ErrThumbnailOnly)
+	}
+
+	w, h, ok := tiffPixelDimensions(t)
+	if !ok || w > maxDeclaredEdge || h > maxDeclaredEdge || w <= b.Dx() || h <= b.Dy() {
+		log.Printf("warning: main image of %s does not decode, using its %dx%d EXIF thumbnail", name, b.Dx(), b.Dy())
+		return img, true, nil
+	}
+	if limit := p.maxPixels(); int64(w)*int64(h) > limit {
+		scale := math.Sqrt(float64(limit) / (float64(w) * float64(h)))
+		w, h = maxInt(1, int(float64(w)*scale)), maxInt(1, int(float64(h)*scale))
+	}
+	log.Printf("warning: main image of %s does not decode, upscaling its %dx%d EXIF thumbnail to %dx%d", name, b.Dx(), b.Dy(), w, h)
+	return imaging.Resize(img, w, h, imaging.Lanczos), true, nil
+}
+
+// exifTIFF returns the TIFF data of the EXIF APP1 segment of JPEG data, looking only at the
+// segments before the image data
+func exifTIFF(data []byte) ([]byte, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, false
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil, false
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF: // fill byte
+			i++
+			continue
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD8: // no length
+			i += 2
+			continue
+		case marker == 0xDA || marker == 0xD9: // image data starts, no EXIF before it
+			return nil, false
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return nil, false
+		}
+		if seg := data[i+4 : i+2+size]; marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:], true
+		}
+		i += 2 + size
+	}
+	return nil, false
+}
+
+// tiffByteOrder returns the byte order declared by the header of TIFF data
+func tiffByteOrder(t []byte) (binary.ByteOrder, bool) {
+	if len(t) < 8 {
+		return nil, false
+	}
+	switch string(t[:2]) {
+	case "II":
+		return binary.LittleEndian, true
+	case "MM":
+		return binary.BigEndian, true
+	}
+	return nil, false
+}
+
+// tiffPixelDimensions reads PixelXDimension and PixelYDimension from the Exif sub-IFD of TIFF data
+func tiffPixelDimensions(t []byte) (w, h int, ok bool) {
+	bo, ok := tiffByteOrder(t)
+	if !ok {
+		return 0, 0, false
+	}
+	exifIFD, ok := tiffTag(t, bo, int(bo.Uint32(t[4:])), 0x8769)
+	if !ok {
+		return 0, 0, false
+	}
+	w, okW := tiffTag(t, bo, exifIFD, 0xA002)
+	h, okH := tiffTag(t, bo, exifIFD, 0xA003)
+	if !okW || !okH || w <= 0 || h <= 0 {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+// tiffThumbnail returns the JPEG thumbnail referenced by IFD1 of TIFF data
+func tiffThumbnail(t []byte) ([]byte, bool) {
+	bo, ok := tiffByteOrder(t)
+	if !ok {
+		return nil, false
+	}
+	ifd0 := int(bo.Uint32(t[4:]))
+	if ifd0 < 8 || ifd0+2 > len(t) {
+		return nil, false
+	}
+	next := ifd0 + 2 + 12*int(bo.Uint16(t[ifd0:]))
+	if next+4 > len(t) {
+		return nil, false
+	}
+	ifd1 := int(bo.Uint32(t[next:]))
+	off, okOff := tiffTag(t, bo, ifd1, 0x0201)
+	n, okLen := tiffTag(t, bo, ifd1, 0x0202)
+	if !okOff || !okLen || off <= 0 || n <= 0 || off > len(t) || n > len(t)-off {
+		return nil, false
+	}
+	return t[off : off+n], true
+}
+
+// tiffTag returns the value of a SHORT or LONG tag in the IFD at offset off
+func tiffTag(t []byte, bo binary.ByteOrder, off int, tag uint16) (int, bool) {
+	if off < 8 || off+2 > len(t) {
+		return 0, false
+	}
+	for i, n := 0, int(bo.Uint16(t[off:])); i < n; i++ {
+		e := off + 2 + 12*i
+		if e+12 > len(t) {
+			return 0, false
+		}
+		if bo.Uint16(t[e:]) != tag {
+			continue
+		}
+		switch bo.Uint16(t[e+2:]) {
+		case 3: // SHORT
+			return int(bo.Uint16(t[e+8:])), true
+		case 4: // LONG
+			return int(bo.Uint32(t[e+8:])), true
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// isTruncatedJPEG reports whether data starts like a JPEG but lacks the end-of-image marker
+func isTruncatedJPEG(data []byte) bool {
+	return len(data) > 4 && data[0] == 0xFF && data[1] == 0xD8 &&
+		!bytes.HasSuffix(bytes.TrimRight(data, "\x00"), []byte{0xFF, 0xD9})
+}
+
+// decodePartialJPEG decodes a truncated JPEG by padding the missing scan data.
+// Padding decodes to plausible-looking garbage, so the same data is decoded again
+// with its last few bytes cut off: the first row that differs between the two decodes
+// is where the real data of the full decode ends, and from there on it is filled with gray.
+func decodePartialJPEG(data []byte) (image.Image, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// Trailing zeros (preallocated, never written) carry no data and decode like the padding
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) <= partialJPEGCut {
+		return nil, fmt.Errorf("truncated JPEG too short to recover")
+	}
+	full, err := decodePaddedJPEG(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	shorter, err := decodePaddedJPEG(data[:len(data)-partialJPEGCut], cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	h := full.Bounds().Dy()
+	firstBad := h
+	for y := 0; y < h; y++ {
+		if !jpegRowsEqual(full, shorter, y) {
+			firstBad = y
+			break
+		}
+	}
+	if firstBad == h {
+		return full, nil
+	}
+	// Round down to an MCU row (at most 16px with chroma subsampling)
+	return fillGrayBelow(full, firstBad-firstBad%16), nil
+}
+
+// partialJPEGCut is how many bytes decodePartialJPEG cuts off for its second decode
+const partialJPEGCut = 16
+
+// decodePaddedJPEG appends zero scan data and an end-of-image marker, then decodes
+func decodePaddedJPEG(data []byte, cfg image.Config) (image.Image, error) {
+	// Zero bits decode to short codes; two bytes per pixel covers the remaining blocks
+	padding := io.LimitReader(zeroReader{}, 2*int64(cfg.Width)*int64(cfg.Height))
+	return jpeg.Decode(io.MultiReader(bytes.NewReader(data), padding, bytes.NewReader([]byte{0xFF, 0xD9})))
+}
+
+// zeroReader is an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// jpegRowsEqual reports whether row y holds the same samples in two decodes of the same JPEG
+func jpegRowsEqual(a, b image.Image, y int) bool {
+	r := a.Bounds()
+	switch a := a.(type) {
+	case *image.YCbCr:
+		b, ok := b.(*image.YCbCr)
+		if !ok {
+			return false
+		}
+		yi, ci, ce := a.YOffset(r.Min.X, y), a.COffset(r.Min.X, y), a.COffset(r.Max.X-1, y)+1
+		return bytes.Equal(a.Y[yi:yi+r.Dx()], b.Y[yi:yi+r.Dx()]) &&
+			bytes.Equal(a.Cb[ci:ce], b.Cb[ci:ce]) && bytes.Equal(a.Cr[ci:ce], b.Cr[ci:ce])
+	case *image.Gray:
+		b, ok := b.(*image.Gray)
+		if !ok {
+			return false
+		}
+		i := a.PixOffset(r.Min.X, y)
+		return bytes.Equal(a.Pix[i:i+r.Dx()], b.Pix[i:i+r.Dx()])
+	case *image.CMYK:
+		b, ok := b.(*image.CMYK)
+		if !ok {
+			return false
+		}
+		i := a.PixOffset(r.Min.X, y)
+		return bytes.Equal(a.Pix[i:i+4*r.Dx()], b.Pix[i:i+4*r.Dx()])
+	}
+	for x := r.Min.X; x < r.Max.X; x++ {
+		if a.At(x, y) != b.At(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// fillGrayBelow fills rows y0 and below of a decoded JPEG with mid gray, in place for the
+// image types the JPEG decoder returns (y0 must be a multiple of the chroma subsampling)
+func fillGrayBelow(img image.Image, y0 int) image.Image {
+	r := img.Bounds()
+	switch img := img.(type) {
+	case *image.YCbCr:
+		fill(img.Y[img.YOffset(r.Min.X, y0):], 128)
+		fill(img.Cb[img.COffset(r.Min.X, y0):], 128)
+		fill(img.Cr[img.COffset(r.Min.X, y0):], 128)
+		return img
+	case *image.Gray:
+		fill(img.Pix[img.PixOffset(r.Min.X, y0):], 128)
+		return img
+	}
+	out := imaging.Clone(img)
+	gray := color.NRGBA{128, 128, 128, 255}
+	for y := y0; y < out.Bounds().Dy(); y++ {
+		drawHLine(out, y, 0, out.Bounds().Dx(), gray)
+	}
+	return out
+}
+
+// fill sets every byte of b to v
+func fill(b []byte, v byte) {
+	for i := range b {
+		b[i] = v
+	}
+}
+
+// decodeSVG rasterizes an SVG document, scaling its longest side to SVGSize when set
+func (p *Processor) decodeSVG(r io.Reader) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(r, oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SVG: %v", err)
+	}
+	w, h := icon.ViewBox.W, icon.ViewBox.H
+	if w <= 0 || h <= 0 {
+		return nil, fmt.Errorf("invalid SVG: missing or empty viewBox/width/height")
+	}
+	if p.SVGSize > 0 {
+		scale := float64(p.SVGSize) / math.Max(w, h)
+		w, h = w*scale, h*scale
+	}
+	// The size comes from the document, so keep it within the pixel limit
+	if limit := float64(p.maxPixels()); w*h > limit {
+		scale := math.Sqrt(limit / (w * h))
+		w, h = math.Floor(w*scale), math.Floor(h*scale)
+	}
+	pw, ph := int(math.Max(1, math.Round(w))), int(math.Max(1, math.Round(h)))
+
+	icon.SetTarget(0, 0, float64(pw), float64(ph))
+	rgba := image.NewRGBA(image.Rect(0, 0, pw, ph))
+	scanner := rasterx.NewScannerGV(pw, ph, rgba, rgba.Bounds())
+	icon.Draw(rasterx.NewDasher(pw, ph, scanner), 1)
+	return rgba, nil
+}
+
+// PrepareImageForModel converts an image to base64 for sending to vision models
+func (p *Processor) PrepareImageForModel(img image.Image, format string, maxDim int, quality int) (string, error) {
+	if maxDim > 0 {
+		b := img.Bounds()
+		w, h := b.Dx(), b.Dy()
+		if w > maxDim || h > maxDim {
+			if w >= h {
+				img = imaging.Resize(img, maxDim, 0, imaging.Lanczos)
+			} else {
+				img = imaging.Resize(img, 0, maxDim, imaging.Lanczos)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	switch strings.ToLower(format) {
+	case "png":
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := enc.Encode(&buf, img); err != nil {
+			return "", err
+		}
+	default: // jpg
+		if err := jpeg.Encode(&buf, p.flatten(img), &jpeg.Options{Quality: quality}); err != nil {
+			return "", err
+		}
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Thumbnail resizes an image so its longest side equals maxEdge, preserving aspect ratio (no upscaling)
+func (p *Processor) Thumbnail(img image.Image, maxEdge int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if maxEdge <= 0 || (w <= maxEdge && h <= maxEdge) {
+		return img
+	}
+	if w >= h {
+		return imaging.Resize(img, maxEdge, 0, imaging.Lanczos)
+	}
+	return imaging.Resize(img, 0, maxEdge, imaging.Lanczos)
+}
+
+// CropImageToBox crops an image to the specified normalized box
+func (p *Processor) CropImageToBox(img image.Image, box types.Box, targetWidth, targetHeight int) (image.Image, error) {
+	bounds := img.Bounds()
+	return p.CropImageToPixelBox(img, PixelRect(box, bounds.Dx(), bounds.Dy()), targetWidth, targetHeight)
+}
+
+// PixelRect converts a normalized box to the pixel rectangle CropImageToBox cuts from an image of
+// imgW x imgH, relative to its top-left corner; the box is clamped to the image and may come out empty
+func PixelRect(box types.Box, imgW, imgH int) image.Rectangle {
+	fw, fh := float64(imgW), float64(imgH)
+	x0 := int(clamp(box.X, 0, 1)*fw + 0.5)
+	y0 := int(clamp(box.Y, 0, 1)*fh + 0.5)
+	x1 := int(clamp(box.X+box.W, 0, 1)*fw + 0.5)
+	y1 := int(clamp(box.Y+box.H, 0, 1)*fh + 0.5)
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// CropImageToPixelBox crops an image to a rectangle in pixels from its top-left corner (as
+// external detectors report them), clamped to the image, and resizes it like CropImageToBox
+func (p *Processor) CropImageToPixelBox(img image.Image, rect image.Rectangle, targetWidth, targetHeight int) (image.Image, error) {
+	bounds := img.Bounds()
+	rect = rect.Canon().Add(bounds.Min).Intersect(bounds)
+	if rect.Empty() {
+		return nil, fmt.Errorf("empty crop rectangle")
+	}
+
+	cropped := imaging.Crop(img, rect)
+
+	// Resize to exact target dimensions while preserving aspect ratio
+	if targetWidth > 0 && targetHeight > 0 {
+		cropped = imaging.Fill(cropped, targetWidth, targetHeight, imaging.Center, imaging.Lanczos)
+	}
+
+	return cropped, nil
+}
+
+// CropImageWithConfig crops an image to the box and applies the config's output size and post-processing
+func (p *Processor) CropImageWithConfig(img image.Image, box types.Box, cfg types.CropConfig) (image.Image, error) {
+	var cropped image.Image
+	if PadsInsteadOfCrop(box, cfg) {
+		cropped = p.fitAndPad(img, cfg.Width, cfg.Height, cfg.Background)
+	} else {
+		if cfg.SnapToEven {
+			box = snapBoxToEven(box, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+		var err error
+		cropped, err = p.CropImageToBox(img, box, cfg.Width, cfg.Height)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PostSharpen > 0 {
+		cropped = p.Sharpen(cropped, cfg.PostSharpen, 1.0)
+	}
+	return cropped, nil
+}
+
+// PadsInsteadOfCrop reports whether CropImageWithConfig keeps the whole image (resized to fit
+// and padded) rather than cutting it to box: for CropModePad, for CropModeAuto when the box
+// discards more than MaxCropLoss of the image, or when the subject reaches
+// FullFrameSubjectThreshold. Padding needs an explicit Width and Height.
+func PadsInsteadOfCrop(box types.Box, cfg types.CropConfig) bool {
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return false
+	}
+	if cfg.FullFrameSubjectThreshold > 0 && cfg.Subject.W*cfg.Subject.H >= cfg.FullFrameSubjectThreshold {
+		// The subject fills the frame, a crop would cut into it
+		return true
+	}
+	switch cfg.Mode {
+	case types.CropModePad:
+		return true
+	case types.CropModeAuto:
+		maxLoss := cfg.MaxCropLoss
+		if maxLoss <= 0 {
+			maxLoss = types.DefaultMaxCropLoss
+		}
+		return 1-clamp(box.W, 0, 1)*clamp(box.H, 0, 1) > maxLoss
+	}
+	return false
+}
+
+// snapBoxToEven rounds a normalized box's pixel size to the nearest even width and height
+// that fits the image (rounding down when rounding up would not fit), keeping it in bounds
+func snapBoxToEven(box types.Box, imgW, imgH int) types.Box {
+	snap := func(start, size float64, total int) (float64, float64) {
+		fw := float64(total)
+		x0 := int(clamp(start, 0, 1)*fw + 0.5)
+		x1 := int(clamp(start+size, 0, 1)*fw + 0.5)
+		n := x1 - x0
+		if n%2 != 0 {
+			if n+1 <= total {
+				n++
+			} else {
+				n--
+			}
+		}
+		if n < 2 {
+			n = minInt(2, total)
+		}
+		// Keep the center where it was, then pull the rectangle back inside the image
+		c := (x0 + x1) / 2
+		x0 = c - n/2
+		if x0+n > total {
+			x0 = total - n
+		}
+		if x0 < 0 {
+			x0 = 0
+		}
+		return float64(x0) / fw, float64(n) / fw
+	}
+	if imgW <= 0 || imgH <= 0 {
+		return box
+	}
+	box.X, box.W = snap(box.X, box.W, imgW)
+	box.Y, box.H = snap(box.Y, box.H, imgH)
+	return box
+}
+
+// CropFrames applies the same normalized crop box and config to every frame (e.g. stills from
+// one video), so a thumbnail strip does not jitter. Detect the subject on a representative
+// frame and compute box from it; all frames must have the size of the first.
+func (p *Processor) CropFrames(frames []image.Image, box types.Box, cfg types.CropConfig) ([]image.Image, error) {
+	if len(frames) == 0 {
+		return nil, nil
+	}
+	size := frames[0].Bounds().Size()
+	out := make([]image.Image, len(frames))
+	for i, frame := range frames {
+		if s := frame.Bounds().Size(); s != size {
+			return nil, fmt.Errorf("frame %d is %dx%d, expected %dx%d", i, s.X, s.Y, size.X, size.Y)
+		}
+		cropped, err := p.CropImageWithConfig(frame, box, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		out[i] = cropped
+	}
+	return out, nil
+}
+
+// AnchoredCrop is one output of CropToSizesAnchored
+type AnchoredCrop struct {
+	Width, Height int
+	Box           types.Box       // normalized crop rectangle in the source image
+	SourceRect    image.Rectangle // the same rectangle in source pixels, from the top-left corner
+	Image         image.Image
+}
+
+// CropToSizesAnchored crops one image to several output sizes around a single subject point
+// (normalized centerX, centerY), so a responsive set stays visually consistent instead of each
+// ratio drifting. Detect once and pass the subject center; every box comes from
+// CalculateOptimalCropBox and is centered on that point as far as the image bounds allow.
+func (p *Processor) CropToSizesAnchored(img image.Image, centerX, centerY float64, sizes []image.Point, zoom float64) ([]AnchoredCrop, error) {
+	b := img.Bounds()
+	out := make([]AnchoredCrop, 0, len(sizes))
+	for _, size := range sizes {
+		if size.X <= 0 || size.Y <= 0 {
+			return nil, fmt.Errorf("invalid crop size %dx%d", size.X, size.Y)
+		}
+		box := p.CalculateOptimalCropBox(centerX, centerY, size.X, size.Y, b.Dx(), b.Dy(), zoom)
+		cropped, err := p.CropImageToBox(img, box, size.X, size.Y)
+		if err != nil {
+			return nil, fmt.Errorf("%dx%d: %v", size.X, size.Y, err)
+		}
+		out = append(out, AnchoredCrop{
+			Width: size.X, Height: size.Y, Box: box, SourceRect: PixelRect(box, b.Dx(), b.Dy()), Image: cropped,
+		})
+	}
+	return out, nil
+}
+
+// CropMaxArea crops the largest centered rectangle with the given width/height ratio, ignoring
+// any subject; it is a deterministic baseline for when detection is unavailable
+func (p *Processor) CropMaxArea(img image.Image, ratio float64) (image.Image, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, fmt.Errorf("empty image")
+	}
+	if ratio <= 0 || math.IsInf(ratio, 0) || math.IsNaN(ratio) {
+		return nil, fmt.Errorf("invalid aspect ratio %v", ratio)
+	}
+	return imaging.Crop(img, MaxInscribedRect(b.Dx(), b.Dy(), ratio).Add(b.Min)), nil
+}
+
+// CropToRatioExcluding crops the largest rectangle with the given width/height ratio, shifted
+// away from the exclusion boxes (watermarks, captions) where the image leaves room
+func (p *Processor) CropToRatioExcluding(img image.Image, ratio float64, exclude []types.Box) (image.Image, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, fmt.Errorf("empty image")
+	}
+	if ratio <= 0 || math.IsInf(ratio, 0) || math.IsNaN(ratio) {
+		return nil, fmt.Errorf("invalid aspect ratio %v", ratio)
+	}
+	r := MaxInscribedRect(b.Dx(), b.Dy(), ratio)
+	fw, fh := float64(b.Dx()), float64(b.Dy())
+	box := types.Box{X: float64(r.Min.X) / fw, Y: float64(r.Min.Y) / fh, W: float64(r.Dx()) / fw, H: float64(r.Dy()) / fh}
+	return p.CropImageToBox(img, p.AvoidRegions(box, types.Box{}, exclude), 0, 0)
+}
+
+// FitMode selects how Fit maps an image onto an exact output size
+type FitMode int
+
+const (
+	// Cover scales the image to fill the output and crops the centered overflow
+	Cover FitMode = iota
+	// Contain scales the whole image into the output and pads the rest with PadColor
+	Contain
+)
+
+// Fit returns an image of exactly width x height using the given fit mode
+func (p *Processor) Fit(img image.Image, width, height int, mode FitMode) (image.Image, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid output size %dx%d", width, height)
+	}
+	if img.Bounds().Empty() {
+		return nil, fmt.Errorf("empty image")
+	}
+	switch mode {
+	case Cover:
+		return imaging.Fill(img, width, height, imaging.Center, imaging.Lanczos), nil
+	case Contain:
+		return p.FitAndPad(img, width, height), nil
+	default:
+		return nil, fmt.Errorf("unknown fit mode %d", mode)
+	}
+}
+
+// FitAndPad resizes the whole image to fit inside width x height and pads the rest with PadColor
+func (p *Processor) FitAndPad(img image.Image, width, height int) image.Image {
+	return p.fitAndPad(img, width, height, nil)
+}
+
+// fitAndPad is FitAndPad with an explicit background, nil = PadColor
+func (p *Processor) fitAndPad(img image.Image, width, height int, bg color.Color) image.Image {
+	if bg == nil {
+		bg = p.PadColor
+	}
+	if bg == nil {
+		bg = p.FlattenBackground
+	}
+	if bg == nil {
+		bg = color.White
+	}
+	b := img.Bounds()
+	// imaging.Fit never upscales, so resize explicitly to the limiting side
+	var fitted *image.NRGBA
+	if float64(b.Dx())*float64(height) >= float64(b.Dy())*float64(width) {
+		fitted = imaging.Resize(img, width, 0, imaging.Lanczos)
+	} else {
+		fitted = imaging.Resize(img, 0, height, imaging.Lanczos)
+	}
+	return imaging.PasteCenter(imaging.New(width, height, bg), fitted)
+}
+
+// Sharpen applies an unsharp mask with the given blur sigma and strength (1.0 = imaging.Sharpen)
+func (p *Processor) Sharpen(img image.Image, sigma float64, amount float64) image.Image {
+	if sigma <= 0 || amount <= 0 {
+		return img
+	}
+	sharp := imaging.Sharpen(img, sigma)
+	if amount == 1.0 {
+		return sharp
+	}
+
+	// Scale the difference between the sharpened and original image by amount
+	orig := imaging.Clone(img)
+	for i := range orig.Pix {
+		if i%4 == 3 {
+			continue // keep alpha
+		}
+		v := float64(orig.Pix[i]) + amount*(float64(sharp.Pix[i])-float64(orig.Pix[i]))
+		orig.Pix[i] = uint8(clamp(v+0.5, 0, 255))
+	}
+	return orig
+}
+
+// ToGrayscale converts an image of any color model to grayscale using Rec. 709 luma weights
+func (p *Processor) ToGrayscale(img image.Image) *image.Gray {
+	src := p.clone(img)
+	defer p.Release(src)
+	b := src.Bounds()
+	gray := image.NewGray(b)
+	for y := 0; y < b.Dy(); y++ {
+		si := y * src.Stride
+		di := y * gray.Stride
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl := float64(src.Pix[si]), float64(src.Pix[si+1]), float64(src.Pix[si+2])
+			gray.Pix[di] = uint8(clamp(0.2126*r+0.7152*g+0.0722*bl+0.5, 0, 255))
+			si += 4
+			di++
+		}
+	}
+	return gray
+}
+
+// CLAHE applies contrast-limited adaptive histogram equalization to the luminance of an image.
+// The image is split into tiles x tiles regions whose histograms are clipped at clipLimit times
+// the mean bin height before equalizing; pixel mappings are blended bilinearly between tiles.
+// Color images keep their chroma: each channel is shifted by the change in luminance.
+func (p *Processor) CLAHE(img image.Image, clipLimit float64, tiles int) image.Image {
+	if tiles < 1 {
+		tiles = 1
+	}
+	if clipLimit < 1 {
+		clipLimit = 1
+	}
+	src := imaging.Clone(img)
+	luma := p.ToGrayscale(src)
+	w, h := luma.Bounds().Dx(), luma.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return src
+	}
+	tw := (w + tiles - 1) / tiles
+	th := (h + tiles - 1) / tiles
+	tilesX := (w + tw - 1) / tw
+	tilesY := (h + th - 1) / th
+
+	// Per-tile lookup tables
+	luts := make([][256]uint8, tilesX*tilesY)
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			var hist [256]int
+			x0, y0 := tx*tw, ty*th
+			x1, y1 := minInt(x0+tw, w), minInt(y0+th, h)
+			for y := y0; y < y1; y++ {
+				for _, v := range luma.Pix[y*luma.Stride+x0 : y*luma.Stride+x1] {
+					hist[v]++
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			limit := int(clipLimit * float64(n) / 256)
+			if limit < 1 {
+				limit = 1
+			}
+			excess := 0
+			for i := range hist {
+				if hist[i] > limit {
+					excess += hist[i] - limit
+					hist[i] = limit
+				}
+			}
+			for i := range hist {
+				hist[i] += excess / 256
+				if i < excess%256 {
+					hist[i]++
+				}
+			}
+			cdf := 0
+			lut := &luts[ty*tilesX+tx]
+			for i := range hist {
+				cdf += hist[i]
+				lut[i] = uint8(clamp(float64(cdf)*255/float64(n)+0.5, 0, 255))
+			}
+		}
+	}
+
+	// Blend the four nearest tile mappings and shift each channel by the luminance change
+	for y := 0; y < h; y++ {
+		fy := clamp((float64(y)+0.5)/float64(th)-0.5, 0, float64(tilesY-1))
+		ty0 := int(fy)
+		ty1 := minInt(ty0+1, tilesY-1)
+		wy := fy - float64(ty0)
+		for x := 0; x < w; x++ {
+			fx := clamp((float64(x)+0.5)/float64(tw)-0.5, 0, float64(tilesX-1))
+			tx0 := int(fx)
+			tx1 := minInt(tx0+1, tilesX-1)
+			wx := fx - float64(tx0)
+
+			v := luma.Pix[y*luma.Stride+x]
+			top := float64(luts[ty0*tilesX+tx0][v])*(1-wx) + float64(luts[ty0*tilesX+tx1][v])*wx
+			bottom := float64(luts[ty1*tilesX+tx0][v])*(1-wx) + float64(luts[ty1*tilesX+tx1][v])*wx
+			delta := top*(1-wy) + bottom*wy - float64(v)
+
+			i := y*src.Stride + x*4
+			for c := 0; c < 3; c++ {
+				src.Pix[i+c] = uint8(clamp(float64(src.Pix[i+c])+delta+0.5, 0, 255))
+			}
+		}
+	}
+	return src
+}
+
+// Deskew analysis settings
+const (
+	deskewAnalysisSize = 512 // longest side the edge analysis runs at
+	deskewStepsPerDeg  = 10  // candidate angles tried per degree
+	deskewMinAngle     = 0.1 // smaller corrections are not worth the resampling
+	deskewEdgeStrength = 64  // minimum Sobel magnitude for a pixel to count as an edge
+)
+
+// Deskew straightens a slightly tilted image. Strong Sobel edges are projected onto rows
+// (horizontal edges) and columns (vertical edges) for each candidate angle up to maxAngleDeg;
+// the angle with the sharpest projection profile levels the image. The image is rotated by
+// that angle and the empty corners are cropped away. It returns the straightened image and
+// the applied counter-clockwise rotation in degrees.
+func (p *Processor) Deskew(img image.Image, maxAngleDeg float64) (image.Image, float64) {
+	maxAngleDeg = clamp(maxAngleDeg, 0, 45)
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if maxAngleDeg == 0 || w < 3 || h < 3 {
+		return img, 0
+	}
+
+	small := img
+	if w > deskewAnalysisSize || h > deskewAnalysisSize {
+		small = imaging.Fit(img, deskewAnalysisSize, deskewAnalysisSize, imaging.Box)
+	}
+	gray := p.ToGrayscale(small)
+	gw, gh := gray.Bounds().Dx(), gray.Bounds().Dy()
+
+	type edge struct {
+		x, y, weight float64
+		horizontal   bool
+	}
+	var edges []edge
+	px := func(x, y int) float64 { return float64(gray.Pix[y*gray.Stride+x]) }
+	for y := 1; y < gh-1; y++ {
+		for x := 1; x < gw-1; x++ {
+			gx := px(x+1, y-1) + 2*px(x+1, y) + px(x+1, y+1) - px(x-1, y-1) - 2*px(x-1, y) - px(x-1, y+1)
+			gy := px(x-1, y+1) + 2*px(x, y+1) + px(x+1, y+1) - px(x-1, y-1) - 2*px(x, y-1) - px(x+1, y-1)
+			if mag := math.Hypot(gx, gy); mag >= deskewEdgeStrength {
+				edges = append(edges, edge{float64(x - gw/2), float64(y - gh/2), mag, math.Abs(gy) > math.Abs(gx)})
+			}
+		}
+	}
+	if len(edges) == 0 {
+		return img, 0
+	}
+
+	// Score each candidate angle by how concentrated the edge projections are
+	diag := int(math.Hypot(float64(gw), float64(gh))) + 2
+	rows := make([]float64, diag)
+	cols := make([]float64, diag)
+	steps := int(maxAngleDeg * deskewStepsPerDeg)
+	angle, bestScore := 0.0, -1.0
+	for i := -steps; i <= steps; i++ {
+		a := float64(i) / deskewStepsPerDeg
+		sin, cos := math.Sincos(a * math.Pi / 180)
+		for k := range rows {
+			rows[k], cols[k] = 0, 0
+		}
+		for _, e := range edges {
+			// Coordinates after rotating the image counter-clockwise by a (y axis points down)
+			rx := e.x*cos + e.y*sin
+			ry := e.y*cos - e.x*sin
+			if e.horizontal {
+				rows[int(ry)+diag/2] += e.weight
+			} else {
+				cols[int(rx)+diag/2] += e.weight
+			}
+		}
+		var score float64
+		for k := range rows {
+			score += rows[k]*rows[k] + cols[k]*cols[k]
+		}
+		// Prefer the smaller correction on ties
+		if score > bestScore || (score == bestScore && math.Abs(a) < math.Abs(angle)) {
+			angle, bestScore = a, score
+		}
+	}
+	if math.Abs(angle) < deskewMinAngle {
+		return img, 0
+	}
+
+	rotated := imaging.Rotate(img, angle, color.Black)
+
+	// Largest centered rectangle of the original aspect ratio inside the rotated frame
+	rad := math.Abs(angle) * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	fw, fh := float64(w), float64(h)
+	scale := math.Min(fw/(fw*cos+fh*sin), fh/(fw*sin+fh*cos))
+	cw, ch := int(fw*scale), int(fh*scale)
+	return imaging.CropCenter(rotated, cw, ch), angle
+}
+
+// CalculateOptimalCropBox calculates the optimal crop box for given aspect ratio centered at a point
+func (p *Processor) CalculateOptimalCropBox(centerX, centerY float64, targetWidth, targetHeight, imgWidth, imgHeight int, zoom float64) types.Box {
+	if zoom <= 0 {
+		zoom = 1
+	}
+
+	r := float64(targetWidth) / float64(targetHeight) // target aspect W/H
+
+	// Center in pixels
+	cx := centerX * float64(imgWidth)
+	cy := centerY * float64(imgHeight)
+
+	// Max half extents allowed by image bounds
+	halfWMax := math.Min(cx, float64(imgWidth)-cx)
+	halfHMax := math.Min(cy, float64(imgHeight)-cy)
+
+	// Width is limited by horizontal bounds AND by vertical bounds scaled by aspect
+	maxWidthPx := math.Min(2*halfWMax, r*(2*halfHMax))
+	widthPx := maxWidthPx * clamp(zoom, 0.01, 1.0)
+	heightPx := widthPx / r
+
+	// Top-left in pixels, clamped
+	x0 := clamp(cx-widthPx/2, 0, float64(imgWidth)-widthPx)
+	y0 := clamp(cy-heightPx/2, 0, float64(imgHeight)-heightPx)
+
+	return types.Box{
+		X: x0 / float64(imgWidth),
+		Y: y0 / float64(imgHeight),
+		W: widthPx / float64(imgWidth),
+		H: heightPx / float64(imgHeight),
+	}
+}
+
+// anchorFractions are the candidate subject positions (fractions of the crop side) per anchor
+var anchorFractions = map[types.CropAnchor][]float64{
+	types.AnchorThirds: {1.0 / 3, 2.0 / 3},
+	types.AnchorGolden: {0.382, 0.618},
+}
+
+// CalculateAnchoredCropBox is like CalculateOptimalCropBox but places the subject center at the
+// anchor's intersection (thirds or golden ratio) closest to achievable within the image bounds.
+// AnchorCenter and unknown anchors fall back to CalculateOptimalCropBox.
+func (p *Processor) CalculateAnchoredCropBox(centerX, centerY float64, targetWidth, targetHeight, imgWidth, imgHeight int, zoom float64, anchor types.CropAnchor) types.Box {
+	fractions, ok := anchorFractions[anchor]
+	if !ok {
+		return p.CalculateOptimalCropBox(centerX, centerY, targetWidth, targetHeight, imgWidth, imgHeight, zoom)
+	}
+	if zoom <= 0 {
+		zoom = 1
+	}
+
+	// The subject no longer needs to be centered, so the crop may use the full image extent
+	r := float64(targetWidth) / float64(targetHeight)
+	fw, fh := float64(imgWidth), float64(imgHeight)
+	widthPx := math.Min(fw, r*fh) * clamp(zoom, 0.01, 1.0)
+	heightPx := widthPx / r
+	cx, cy := centerX*fw, centerY*fh
+
+	// Pick the anchor per axis whose placement survives clamping to the image best
+	place := func(c, size, limit float64) float64 {
+		best, bestErr := 0.0, math.Inf(1)
+		for _, f := range fractions {
+			start := clamp(c-f*size, 0, limit-size)
+			if e := math.Abs((c-start)/size - f); e < bestErr {
+				best, bestErr = start, e
+			}
+		}
+		return best
+	}
+	x0 := place(cx, widthPx, fw)
+	y0 := place(cy, heightPx, fh)
+
+	return types.Box{
+		X: x0 / fw,
+		Y: y0 / fh,
+		W: widthPx / fw,
+		H: heightPx / fh,
+	}
+}
+
+// Portrait framing proportions used by CalculatePortraitCropBox and EstimateHeadBox
+const (
+	DefaultHeadroom = 0.08 // share of the crop height left above the head
+	eyeLevel        = 0.45 // eye line as a fraction of the head box height
+	headWidthRatio  = 0.6  // head height relative to the width of a person box
+)
+
+// EstimateHeadBox approximates the head inside a person box: the top of the box, centered,
+// about 0.6 x the box width tall (a third of a standing figure's width, half of a bust's)
+func EstimateHeadBox(person types.Box) types.Box {
+	h := math.Min(person.H, person.W*headWidthRatio)
+	w := math.Min(person.W, h*0.8)
+	return types.Box{X: person.X + (person.W-w)/2, Y: person.Y, W: w, H: h}
+}
+
+// CalculatePortraitCropBox frames a face (or head) box using portrait rules: the eye line sits
+// on the upper third of the crop, the crop is centered horizontally on the face, and at least
+// headroom (fraction of the crop height) is left above the head. The crop grows beyond zoom
+// if needed to keep the whole face in frame.
+func (p *Processor) CalculatePortraitCropBox(face types.Box, targetWidth, targetHeight, imgWidth, imgHeight int, zoom, headroom float64) types.Box {
+	if zoom <= 0 {
+		zoom = 1
+	}
+	headroom = clamp(headroom, 0, 0.5)
+	r := float64(targetWidth) / float64(targetHeight)
+	fw, fh := float64(imgWidth), float64(imgHeight)
+	maxW := math.Min(fw, r*fh)
+
+	faceX, faceY, faceW, faceH := face.X*fw, face.Y*fh, face.W*fw, face.H*fh
+	widthPx := maxW * clamp(zoom, 0.01, 1.0)
+	// The face plus headroom must fit above the bottom of the crop
+	minH := faceH / (1 - headroom)
+	widthPx = math.Min(math.Max(widthPx, math.Max(minH*r, faceW)), maxW)
+	heightPx := widthPx / r
+
+	eye := faceY + eyeLevel*faceH
+	y0 := eye - heightPx/3
+	// Leave at least the headroom above the top of the head
+	y0 = math.Min(y0, faceY-headroom*heightPx)
+	y0 = clamp(y0, 0, fh-heightPx)
+	x0 := clamp(faceX+faceW/2-widthPx/2, 0, fw-widthPx)
+
+	return types.Box{X: x0 / fw, Y: y0 / fh, W: widthPx / fw, H: heightPx / fh}
+}
+
+// SubjectCoverage returns the fraction (0-1) of the subject box's area that lies inside the crop box
+func SubjectCoverage(subject, crop types.Box) float64 {
+	area := subject.W * subject.H
+	if area <= 0 {
+		return 0
+	}
+	w := math.Min(subject.X+subject.W, crop.X+crop.W) - math.Max(subject.X, crop.X)
+	h := math.Min(subject.Y+subject.H, crop.Y+crop.H) - math.Max(subject.Y, crop.Y)
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	return clamp(w*h/area, 0, 1)
+}
+
+// MaxInscribedRect returns the largest rectangle with the given width/height ratio that fits
+// in an imgW x imgH image, centered; a ratio <= 0 returns the whole image
+func MaxInscribedRect(imgW, imgH int, ratio float64) image.Rectangle {
+	if imgW <= 0 || imgH <= 0 {
+		return image.Rectangle{}
+	}
+	w, h := imgW, imgH
+	if ratio > 0 {
+		if float64(imgW)/float64(imgH) > ratio {
+			w = minInt(imgW, int(math.Round(float64(imgH)*ratio)))
+		} else {
+			h = minInt(imgH, int(math.Round(float64(imgW)/ratio)))
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	x0, y0 := (imgW-w)/2, (imgH-h)/2
+	return image.Rect(x0, y0, x0+w, y0+h)
+}
+
+// Placement costs for AvoidRegions, in units of a fully covered box
+const (
+	excludeOverlapCost = 1.0  // per exclusion box entirely inside the crop
+	subjectLossCost    = 2.0  // for the subject box entirely outside the crop
+	moveCost           = 0.25 // per unit of normalized distance the crop is moved
+	avoidSearchSteps   = 64   // candidate positions per axis
+)
+
+// AvoidRegions moves a normalized crop box (keeping its size) to reduce its overlap with the
+// exclusion boxes. Small moves are preferred and losing the subject box (if non-empty) costs
+// more than keeping an exclusion, so the subject stays in frame when the two conflict.
+func (p *Processor) AvoidRegions(crop, subject types.Box, exclude []types.Box) types.Box {
+	if len(exclude) == 0 {
+		return crop
+	}
+	cost := func(c types.Box) float64 {
+		var v float64
+		for _, ex := range exclude {
+			v += excludeOverlapCost * SubjectCoverage(ex, c)
+		}
+		if subject.W > 0 && subject.H > 0 {
+			v += subjectLossCost * (1 - SubjectCoverage(subject, c))
+		}
+		return v + moveCost*math.Hypot(c.X-crop.X, c.Y-crop.Y)
+	}
+
+	best, bestCost := crop, cost(crop)
+	maxX, maxY := math.Max(1-crop.W, 0), math.Max(1-crop.H, 0)
+	for i := 0; i <= avoidSearchSteps; i++ {
+		for j := 0; j <= avoidSearchSteps; j++ {
+			c := crop
+			c.X = maxX * float64(i) / avoidSearchSteps
+			c.Y = maxY * float64(j) / avoidSearchSteps
+			if v := cost(c); v < bestCost {
+				best, bestCost = c, v
+			}
+		}
+	}
+	return best
+}
+
+// FindNearestPointToCenter finds the nearest point in a box to the image center
+func (p *Processor) FindNearestPointToCenter(box types.Box) (float64, float64) {
+	cx := clamp(0.5, box.X, box.X+box.W)
+	cy := clamp(0.5, box.Y, box.Y+box.H)
+	return cx, cy
+}
+
+// SaveImage saves an image to a file with the specified format and quality
+func (p *Processor) SaveImage(img image.Image, path, format string, quality int, lossless bool) error {
+	data, err := p.EncodeImage(img, format, quality, lossless)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// SaveImageAuto saves an image like SaveImage, choosing WebP lossless mode from the image content
+func (p *Processor) SaveImageAuto(img image.Image, path, format string, quality int) error {
+	lossless := strings.ToLower(format) == "webp" && p.PreferLossless(img)
+	return p.SaveImage(img, path, format, quality, lossless)
+}
+
+// Content sampling limits for PreferLossless
+const (
+	losslessSampleGrid   = 128 // sample at most this many pixels per axis
+	losslessMaxColors    = 256 // this few distinct sampled colors means graphics
+	losslessFlatFraction = 0.6 // or this share of sampled pixels equal to their right neighbour
+)
+
+// PreferLossless reports whether an image looks like graphics or line art (few colors,
+// large flat areas) that compresses better lossless; photographic content returns false
+func (p *Processor) PreferLossless(img image.Image) bool {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return false
+	}
+	stepX, stepY := w/losslessSampleGrid, h/losslessSampleGrid
+	if stepX < 1 {
+		stepX = 1
+	}
+	if stepY < 1 {
+		stepY = 1
+	}
+
+	colors := map[color.NRGBA]struct{}{}
+	same, pairs := 0, 0
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			colors[c] = struct{}{}
+			if x+1 < b.Max.X {
+				pairs++
+				if color.NRGBAModel.Convert(img.At(x+1, y)).(color.NRGBA) == c {
+					same++
+				}
+			}
+		}
+	}
+	if len(colors) <= losslessMaxColors {
+		return true
+	}
+	return pairs > 0 && float64(same)/float64(pairs) >= losslessFlatFraction
+}
+
+// ImageKind is the broad kind of content in an image, see ClassifyImageKind
+type ImageKind string
+
+const (
+	KindPhoto      ImageKind = "photo"      // camera image: noise and smooth gradients
+	KindScreenshot ImageKind = "screenshot" // UI capture: flat areas with many hard edges (text)
+	KindGraphic    ImageKind = "graphic"    // logo, chart or illustration: few colors, few edges
+)
+
+// Sampling thresholds for ClassifyImageKind
+const (
+	kindPhotoFlatMax      = 0.3  // below this share of equal neighbours the image is a photo
+	kindScreenshotFlatMin = 0.5  // screenshots are mostly flat ...
+	kindScreenshotEdgeMin = 0.03 // ... with this share of hard edges
+	kindHardEdgeLuma      = 0.25 // luma step (0-1) between neighbours that counts as a hard edge
+)
+
+// ClassifyImageKind guesses whether an image is a photo, a screenshot or a graphic from the
+// sampled color count, the share of flat (equal) neighbouring pixels and the hard-edge density.
+// Callers can use it to choose a cropping or encoding strategy.
+func (p *Processor) ClassifyImageKind(img image.Image) ImageKind {
+	b := img.Bounds()
+	if b.Dx() < 2 || b.Dy() == 0 {
+		return KindGraphic
+	}
+	stepX, stepY := maxInt(1, b.Dx()/losslessSampleGrid), maxInt(1, b.Dy()/losslessSampleGrid)
+	luma := func(c color.NRGBA) float64 {
+		return (0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)) / 255
+	}
+
+	colors := map[color.NRGBA]struct{}{}
+	same, hard, pairs := 0, 0, 0
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x+1 < b.Max.X; x += stepX {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			next := color.NRGBAModel.Convert(img.At(x+1, y)).(color.NRGBA)
+			colors[c] = struct{}{}
+			pairs++
+			if next == c {
+				same++
+			} else if math.Abs(luma(next)-luma(c)) >= kindHardEdgeLuma {
+				hard++
+			}
+		}
+	}
+	flat := float64(same) / float64(pairs)
+	edges := float64(hard) / float64(pairs)
+	switch {
+	case flat < kindPhotoFlatMax:
+		return KindPhoto
+	case flat >= kindScreenshotFlatMin && edges >= kindScreenshotEdgeMin:
+		return KindScreenshot
+	case len(colors) <= losslessMaxColors || flat >= losslessFlatFraction:
+		return KindGraphic
+	default:
+		return KindPhoto
+	}
+}
+
+// EncodeImage encodes an image in memory with the specified format (jpg/jpeg, png, webp, avif)
+// and quality; other formats are an error
+func (p *Processor) EncodeImage(img image.Image, format string, quality int, lossless bool) ([]byte, error) {
+	var buf bytes.Buffer
+	switch strings.ToLower(format) {
+	case "webp":
+		opts := &webp.Options{Lossless: lossless, Quality: float32(quality)}
+		if err := webp.Encode(&buf, img, opts); err != nil {
+			return nil, err
+		}
+	case "png":
+		if err := imaging.Encode(&buf, p.toPNGColorType(img), imaging.PNG); err != nil {
+			return nil, err
+		}
+	case "avif":
+		if avifEncoder == nil {
+			return nil, ErrAVIFUnavailable
+		}
+		if err := avifEncoder(&buf, img, quality); err != nil {
+			return nil, fmt.Errorf("avif encode: %v", err)
+		}
+	case "jpg", "jpeg":
+		if err := imaging.Encode(&buf, p.flatten(img), imaging.JPEG, imaging.JPEGQuality(quality)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported output format %q (supported: %s)", format, strings.Join(SupportedOutputFormats(), ", "))
+	}
+	if p.TagSRGB {
+		return withSRGBTag(format, buf.Bytes()), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// withSRGBTag marks encoded JPEG or PNG data as sRGB: PNGs get an sRGB chunk after IHDR, JPEGs
+// an embedded sRGB ICC profile (APP2). Other formats and unexpected data are returned unchanged.
+func withSRGBTag(format string, data []byte) []byte {
+	switch strings.ToLower(format) {
+	case "png":
+		// The signature and IHDR chunk are always first and 8+25 bytes long
+		const ihdrEnd = 8 + 25
+		if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+			return data
+		}
+		chunk := []byte{0, 0, 0, 1, 's', 'R', 'G', 'B', 0} // perceptual rendering intent
+		chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+		return append(append(append([]byte{}, data[:ihdrEnd]...), chunk...), data[ihdrEnd:]...)
+	case "webp", "avif":
+		return data
+	default: // jpg/jpeg
+		if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+			return data
+		}
+		profile := srgbProfile()
+		seg := append([]byte("ICC_PROFILE\x00\x01\x01"), profile...) // chunk 1 of 1
+		app2 := []byte{0xFF, 0xE2, byte((len(seg) + 2) >> 8), byte(len(seg) + 2)}
+		return append(append(append(append([]byte{}, data[:2]...), app2...), seg...), data[2:]...)
+	}
+}
+
+// srgbProfile is a minimal ICC v2 display profile for sRGB (D50-adapted primaries and the sRGB
+// tone curve as a 1024-entry table shared by the three channels), small enough for one APP2 segment
+var srgbProfile = sync.OnceValue(func() []byte {
+	s15 := func(v float64) []byte { return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(v*65536)))) }
+	xyz := func(x, y, z float64) []byte {
+		b := append([]byte("XYZ "), 0, 0, 0, 0)
+		return append(append(append(b, s15(x)...), s15(y)...), s15(z)...)
+	}
+	const name = "sRGB"
+	desc := append([]byte("desc"), 0, 0, 0, 0)
+	desc = binary.BigEndian.AppendUint32(desc, uint32(len(name)+1))
+	desc = append(append(desc, name...), 0)
+	desc = append(desc, make([]byte, 4+4+2+1+67)...) // empty Unicode and ScriptCode descriptions
+	cprt := append(append([]byte("text"), 0, 0, 0, 0), "No copyright, use freely\x00"...)
+	const points = 1024
+	trc := append([]byte("curv"), 0, 0, 0, 0)
+	trc = binary.BigEndian.AppendUint32(trc, points)
+	for i := 0; i < points; i++ {
+		v := float64(i) / (points - 1)
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		trc = binary.BigEndian.AppendUint16(trc, uint16(math.Round(v*65535)))
+	}
+
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", desc},
+		{"cprt", cprt},
+		{"wtpt", xyz(0.9642, 1.0, 0.8249)},
+		{"rXYZ", xyz(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", xyz(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", xyz(0.1431, 0.0606, 0.7141)},
+		{"rTRC", trc},
+		{"gTRC", trc},
+		{"bTRC", trc},
+	}
+	table := 4 + 12*len(tags)
+	body := []byte{}
+	entries := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	offsets := map[string]int{} // the TRC tags share one copy of the curve
+	for _, t := range tags {
+		off, ok := offsets[string(t.data)]
+		if !ok {
+			off = 128 + table + len(body)
+			offsets[string(t.data)] = off
+			body = append(body, t.data...)
+			for len(body)%4 != 0 {
+				body = append(body, 0)
+			}
+		}
+		entries = append(entries, t.sig...)
+		entries = binary.BigEndian.AppendUint32(entries, uint32(off))
+		entries = binary.BigEndian.AppendUint32(entries, uint32(len(t.data)))
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(128+table+len(body)))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000) // version 2.1
+	copy(header[12:], "mntrRGB XYZ ")
+	binary.BigEndian.PutUint16(header[24:], 2000) // creation date 2000-01-01
+	binary.BigEndian.PutUint16(header[26:], 1)
+	binary.BigEndian.PutUint16(header[28:], 1)
+	copy(header[36:], "acsp")
+	copy(header[68:], s15(0.9642)) // D50 PCS illuminant
+	copy(header[72:], s15(1.0))
+	copy(header[76:], s15(0.8249))
+	return append(append(header, entries...), body...)
+})
+
+// Pipeline chains Processor operations on one image. Steps run lazily when Image or Encode is
+// called; the first failing step stops the chain and its error is returned.
+type Pipeline struct {
+	p     *Processor
+	img   image.Image
+	steps []func(image.Image) (image.Image, error)
+}
+
+// NewPipeline starts a pipeline on img using the processor's settings
+func (p *Processor) NewPipeline(img image.Image) *Pipeline {
+	return &Pipeline{p: p, img: img}
+}
+
+// Then appends a custom step
+func (pl *Pipeline) Then(step func(image.Image) (image.Image, error)) *Pipeline {
+	pl.steps = append(pl.steps, step)
+	return pl
+}
+
+// Resize scales the image so its longest side is at most maxEdge (see Thumbnail)
+func (pl *Pipeline) Resize(maxEdge int) *Pipeline {
+	return pl.Then(func(img image.Image) (image.Image, error) { return pl.p.Thumbnail(img, maxEdge), nil })
+}
+
+// Deskew straightens a tilt of up to maxAngleDeg (see Deskew)
+func (pl *Pipeline) Deskew(maxAngleDeg float64) *Pipeline {
+	return pl.Then(func(img image.Image) (image.Image, error) {
+		out, _ := pl.p.Deskew(img, maxAngleDeg)
+		return out, nil
+	})
+}
+
+// CLAHE applies adaptive contrast enhancement (see CLAHE)
+func (pl *Pipeline) CLAHE(clipLimit float64, tiles int) *Pipeline {
+	return pl.Then(func(img image.Image) (image.Image, error) { return pl.p.CLAHE(img, clipLimit, tiles), nil })
+}
+
+// Crop crops to a normalized box and resizes to width x height (see CropImageToBox)
+func (pl *Pipeline) Crop(box types.Box, width, height int) *Pipeline {
+	return pl.Then(func(img image.Image) (image.Image, error) { return pl.p.CropImageToBox(img, box, width, height) })
+}
+
+// Fit maps the image onto exactly width x height (see Fit)
+func (pl *Pipeline) Fit(width, height int, mode FitMode) *Pipeline {
+	return pl.Then(func(img image.Image) (image.Image, error) { return pl.p.Fit(img, width, height, mode) })
+}
+
+// Sharpen applies an unsharp mask (see Sharpen)
+func (pl *Pipeline) Sharpen(sigma, amount float64) *Pipeline {
+	return pl.Then(func(img image.Image) (image.Image, error) { return pl.p.Sharpen(img, sigma, amount), nil })
+}
+
+// Grayscale converts to Rec. 709 grayscale (see ToGrayscale)
+func (pl *Pipeline) Grayscale() *Pipeline {
+	return pl.Then(func(img image.Image) (image.Image, error) { return pl.p.ToGrayscale(img), nil })
+}
+
+// Image runs the steps and returns the resulting image
+func (pl *Pipeline) Image() (image.Image, error) {
+	if pl.img == nil {
+		return nil, fmt.Errorf("pipeline has no image")
+	}
+	img := pl.img
+	for i, step := range pl.steps {
+		out, err := step(img)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline step %d: %v", i+1, err)
+		}
+		img = out
+	}
+	return img, nil
+}
+
+// Encode runs the steps and encodes the result (see EncodeImage)
+func (pl *Pipeline) Encode(format string, quality int, lossless bool) ([]byte, error) {
+	img, err := pl.Image()
+	if err != nil {
+		return nil, err
+	}
+	return pl.p.EncodeImage(img, format, quality, lossless)
+}
+
+// ContentTypeForFormat returns the MIME type for an output format name (jpg|jpeg|png|webp|avif)
+func ContentTypeForFormat(format string) string {
+	switch strings.ToLower(format) {
+	case "png":
+		return "image/png"
+	case "webp":
+		return "image/webp"
+	case "avif":
+		return "image/avif"
+	default: // jpg/jpeg, matching EncodeImage
+		return "image/jpeg"
+	}
+}
+
+// ToDataURL encodes an image and returns it as a data: URL for use in an <img src>
+func (p *Processor) ToDataURL(img image.Image, format string, quality int) (string, error) {
+	data, err := p.EncodeImage(img, format, quality, false)
+	if err != nil {
+		return "", err
+	}
+	return "data:" + ContentTypeForFormat(format) + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Quality search bounds for EncodeToTargetSize
+const (
+	minTargetQuality     = 1
+	maxTargetQuality     = 100
+	maxTargetSizeAttempt = 8 // enough for a binary search over 1..100
+)
+
+// EncodeToTargetSize encodes an image with the highest quality that fits in maxBytes.
+// It returns the encoded bytes and the chosen quality; if even the minimum quality
+// is too large, the minimum-quality bytes are returned along with an error.
+func (p *Processor) EncodeToTargetSize(img image.Image, format string, maxBytes int64) ([]byte, int, error) {
+	if maxBytes <= 0 {
+		return nil, 0, fmt.Errorf("invalid target size: %d bytes", maxBytes)
+	}
+
+	// PNG has no quality knob, a single encode decides
+	if strings.ToLower(format) == "png" {
+		data, err := p.EncodeImage(img, format, maxTargetQuality, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		if int64(len(data)) > maxBytes {
+			return data, maxTargetQuality, fmt.Errorf("png output is %d bytes, exceeds target of %d bytes", len(data), maxBytes)
+		}
+		return data, maxTargetQuality, nil
+	}
+
+	lo, hi := minTargetQuality, maxTargetQuality
+	var best []byte
+	bestQ := 0
+	for i := 0; i < maxTargetSizeAttempt && lo <= hi; i++ {
+		q := (lo + hi + 1) / 2
+		data, err := p.EncodeImage(img, format, q, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		if int64(len(data)) <= maxBytes {
+			best, bestQ = data, q
+			lo = q + 1
+		} else {
+			hi = q - 1
+		}
+	}
+	if best != nil {
+		return best, bestQ, nil
+	}
+
+	data, err := p.EncodeImage(img, format, minTargetQuality, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(data)) <= maxBytes {
+		return data, minTargetQuality, nil
+	}
+	return data, minTargetQuality, fmt.Errorf("cannot encode under %d bytes (%d bytes at quality %d)", maxBytes, len(data), minTargetQuality)
+}
+
+// PackAtlas packs named images into a single atlas no wider than maxWidth using shelf packing.
+// It returns the atlas and the rectangle each image occupies in it.
+func (p *Processor) PackAtlas(crops map[string]image.Image, maxWidth int) (image.Image, map[string]image.Rectangle, error) {
+	if len(crops) == 0 {
+		return nil, nil, fmt.Errorf("no images to pack")
+	}
+	if maxWidth <= 0 {
+		return nil, nil, fmt.Errorf("invalid atlas width: %d", maxWidth)
+	}
+
+	// Tallest first keeps shelves dense; names break ties for a stable layout
+	names := make([]string, 0, len(crops))
+	for name, img := range crops {
+		if w := img.Bounds().Dx(); w > maxWidth {
+			return nil, nil, fmt.Errorf("image %s is %dpx wide, exceeds atlas width %d", name, w, maxWidth)
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		hi, hj := crops[names[i]].Bounds().Dy(), crops[names[j]].Bounds().Dy()
+		if hi != hj {
+			return hi > hj
+		}
+		return names[i] < names[j]
+	})
+
+	rects := make(map[string]image.Rectangle, len(crops))
+	x, y, shelfH, atlasW := 0, 0, 0, 0
+	for _, name := range names {
+		b := crops[name].Bounds()
+		if x+b.Dx() > maxWidth {
+			// Start a new shelf below the current one
+			x, y, shelfH = 0, y+shelfH, 0
+		}
+		rects[name] = image.Rect(x, y, x+b.Dx(), y+b.Dy())
+		x += b.Dx()
+		if b.Dy() > shelfH {
+			shelfH = b.Dy()
+		}
+		if x > atlasW {
+			atlasW = x
+		}
+	}
+
+	atlas := image.NewNRGBA(image.Rect(0, 0, atlasW, y+shelfH))
+	for name, r := range rects {
+		src := crops[name]
+		draw.Draw(atlas, r, src, src.Bounds().Min, draw.Src)
+	}
+	return atlas, rects, nil
+}
+
+// AverageHash computes a 64-bit perceptual (average) hash of an image
+func (p *Processor) AverageHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 8, 8, imaging.Box))
+	var sum int
+	for i := 0; i < 64; i++ {
+		sum += int(small.Pix[i*4])
+	}
+	avg := sum / 64
+
+	var hash uint64
+	for i := 0; i < 64; i++ {
+		if int(small.Pix[i*4]) >= avg {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// HashDistance returns the number of differing bits between two perceptual hashes
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// CreateDebugOverlay creates an overlay image showing detection and crop boxes
+func (p *Processor) CreateDebugOverlay(img image.Image, modelBox, cropBox types.Box, cropCx, cropCy float64) image.Image {
+	nrgba := p.clone(img)
+	w := nrgba.Bounds().Dx()
+	h := nrgba.Bounds().Dy()
+
+	// Colors
+	green := color.NRGBA{0, 255, 0, 255}                  // model box
+	gold := color.NRGBA{255, 204, 0, 255}                 // crop box
+	red := color.NRGBA{255, 0, 0, 255}                    // crop center
+	blue := color.NRGBA{0, 170, 255, 255}                 // image center
+	stroke := int(math.Max(2, 0.004*float64(minInt(w, h)))) // ~0.4% of min side
+	cross := int(math.Max(4, 0.01*float64(minInt(w, h))))   // ~1% of min side
+
+	// Draw model box
+	drawBox(nrgba, modelBox, w, h, green, stroke)
+
+	// Draw crop box if valid
+	if cropBox.W > 0 && cropBox.H > 0 {
+		drawBox(nrgba, cropBox, w, h, gold, stroke)
+	}
+
+	// Draw crop center crosshair
+	px := int(clamp(cropCx, 0, 1)*float64(w) + 0.5)
+	py := int(clamp(cropCy, 0, 1)*float64(h) + 0.5)
+	drawHLine(nrgba, py, px-cross, px+cross, red)
+	drawVLine(nrgba, px, py-cross, py+cross, red)
+
+	// Draw image center marker
+	ix, iy := w/2, h/2
+	drawHLine(nrgba, iy, ix-6, ix+6, blue)
+	drawVLine(nrgba, ix, iy-6, iy+6, blue)
+
+	return nrgba
+}
+
+// overlayPalette are the distinct colors CreateMultiCropOverlay cycles through
+var overlayPalette = []color.NRGBA{
+	{230, 25, 75, 255},   // red
+	{60, 180, 75, 255},   // green
+	{0, 130, 200, 255},   // blue
+	{255, 225, 25, 255},  // yellow
+	{245, 130, 48, 255},  // orange
+	{145, 30, 180, 255},  // purple
+	{70, 240, 240, 255},  // cyan
+	{240, 50, 230, 255},  // magenta
+	{210, 245, 60, 255},  // lime
+	{250, 190, 212, 255}, // pink
+}
+
+// CreateMultiCropOverlay draws every named crop rectangle (pixel coordinates of img) onto a copy
+// of img, each in its own color with its name in a small tag at the top-left corner. Crops are
+// drawn in name order, so colors are stable between runs.
+func (p *Processor) CreateMultiCropOverlay(img image.Image, crops map[string]image.Rectangle) image.Image {
+	nrgba := p.clone(img)
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	stroke := int(math.Max(2, 0.004*float64(minInt(w, h))))
+
+	names := make([]string, 0, len(crops))
+	for name := range crops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	face := basicfont.Face7x13
+	var tags []image.Rectangle
+	for i, name := range names {
+		c := overlayPalette[i%len(overlayPalette)]
+		r := crops[name].Sub(b.Min).Intersect(image.Rect(0, 0, w, h))
+		if r.Empty() {
+			continue
+		}
+		box := types.Box{
+			X: float64(r.Min.X) / float64(w), Y: float64(r.Min.Y) / float64(h),
+			W: float64(r.Dx()) / float64(w), H: float64(r.Dy()) / float64(h),
+		}
+		drawBox(nrgba, box, w, h, c, stroke)
+
+		// Name tag inside the top-left corner, dark text on the crop's color; crops sharing a
+		// corner get their tags stacked instead of drawn over each other
+		tw := font.MeasureString(face, name).Ceil() + 6
+		tag := image.Rect(r.Min.X, r.Min.Y, r.Min.X+tw, r.Min.Y+face.Height+4)
+		for moved := true; moved; {
+			moved = false
+			for _, t := range tags {
+				if tag.Overlaps(t) {
+					tag = tag.Add(image.Pt(0, t.Max.Y-tag.Min.Y))
+					moved = true
+				}
+			}
+		}
+		tags = append(tags, tag)
+		draw.Draw(nrgba, tag, image.NewUniform(c), image.Point{}, draw.Src)
+		d := &font.Drawer{Dst: nrgba, Src: image.Black, Face: face,
+			Dot: fixed.P(tag.Min.X+3, tag.Min.Y+2+face.Ascent)}
+		d.DrawString(name)
+	}
+	return nrgba
+}
+
+// Search parameters for FindQuietRegion
+const (
+	quietAnalysisSize = 256 // longest side the edge map is computed at
+	quietScaleSteps   = 9   // candidate sizes from the largest fitting rectangle down to 20% of it
+	quietGridSteps    = 24  // candidate positions per axis
+	quietEnergyFactor = 0.5 // a region is quiet when its edge energy is at most this share of the image mean
+)
+
+// FindQuietRegion returns a normalized box with the given width/height ratio that avoids the
+// subject box and has little detail (low Sobel edge energy), e.g. for placing text on a card.
+// The largest size with a quiet candidate wins; if no candidate is quiet, the least busy one
+// of any size is returned. An error is returned when the subject leaves no room.
+func (p *Processor) FindQuietRegion(img image.Image, subject types.Box, ratio float64) (types.Box, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return types.Box{}, fmt.Errorf("empty image")
+	}
+	if ratio <= 0 || math.IsInf(ratio, 0) || math.IsNaN(ratio) {
+		return types.Box{}, fmt.Errorf("invalid aspect ratio %v", ratio)
+	}
+
+	small := img
+	if b.Dx() > quietAnalysisSize || b.Dy() > quietAnalysisSize {
+		small = imaging.Fit(img, quietAnalysisSize, quietAnalysisSize, imaging.Box)
+	}
+	gray := p.ToGrayscale(small)
+	gw, gh := gray.Bounds().Dx(), gray.Bounds().Dy()
+
+	// Integral image of the edge magnitude, so any rectangle's energy is four lookups
+	integral := make([]float64, (gw+1)*(gh+1))
+	px := func(x, y int) float64 {
+		x, y = minInt(maxInt(x, 0), gw-1), minInt(maxInt(y, 0), gh-1)
+		return float64(gray.Pix[y*gray.Stride+x])
+	}
+	for y := 0; y < gh; y++ {
+		var row float64
+		for x := 0; x < gw; x++ {
+			gx := px(x+1, y-1) + 2*px(x+1, y) + px(x+1, y+1) - px(x-1, y-1) - 2*px(x-1, y) - px(x-1, y+1)
+			gy := px(x-1, y+1) + 2*px(x, y+1) + px(x+1, y+1) - px(x-1, y-1) - 2*px(x, y-1) - px(x+1, y-1)
+			row += math.Hypot(gx, gy)
+			integral[(y+1)*(gw+1)+x+1] = integral[y*(gw+1)+x+1] + row
+		}
+	}
+	energy := func(c types.Box) float64 {
+		x0, y0, x1, y1 := boxToPixels(c, gw, gh)
+		x1, y1 = minInt(x1, gw), minInt(y1, gh)
+		if x1 <= x0 || y1 <= y0 {
+			// Rounded to nothing at the analysis size (tiny images, windows at the far edge)
+			return math.Inf(1)
+		}
+		sum := integral[y1*(gw+1)+x1] - integral[y0*(gw+1)+x1] - integral[y1*(gw+1)+x0] + integral[y0*(gw+1)+x0]
+		return sum / float64((x1-x0)*(y1-y0))
+	}
+	quiet := quietEnergyFactor * energy(types.Box{W: 1, H: 1})
+
+	full := MaxInscribedRect(b.Dx(), b.Dy(), ratio)
+	fullW, fullH := float64(full.Dx())/float64(b.Dx()), float64(full.Dy())/float64(b.Dy())
+	var best types.Box
+	bestEnergy := math.Inf(1)
+	for s := 0; s < quietScaleSteps; s++ {
+		scale := 1 - 0.8*float64(s)/float64(quietScaleSteps-1)
+		w, h := fullW*scale, fullH*scale
+		for i := 0; i <= quietGridSteps; i++ {
+			for j := 0; j <= quietGridSteps; j++ {
+				c := types.Box{X: (1 - w) * float64(i) / quietGridSteps, Y: (1 - h) * float64(j) / quietGridSteps, W: w, H: h}
+				if SubjectCoverage(subject, c) > 0 {
+					continue
+				}
+				if e := energy(c); e < bestEnergy {
+					best, bestEnergy = c, e
+				}
+			}
+		}
+		// Larger sizes are tried first, so the first quiet candidate is the largest
+		if bestEnergy <= quiet {
+			return best, nil
+		}
+	}
+	if math.IsInf(bestEnergy, 1) {
+		return types.Box{}, fmt.Errorf("no region of ratio %.2f avoids the subject", ratio)
+	}
+	return best, nil
+}
+
+// colorNames is the palette NearestColorName picks from (CSS color values)
+var colorNames = []struct {
+	name string
+	c    color.RGBA
+}{
+	{"black", color.RGBA{0, 0, 0, 255}},
+	{"white", color.RGBA{255, 255, 255, 255}},
+	{"gray", color.RGBA{128, 128, 128, 255}},
+	{"silver", color.RGBA{192, 192, 192, 255}},
+	{"red", color.RGBA{255, 0, 0, 255}},
+	{"maroon", color.RGBA{128, 0, 0, 255}},
+	{"crimson", color.RGBA{220, 20, 60, 255}},
+	{"orange", color.RGBA{255, 165, 0, 255}},
+	{"coral", color.RGBA{255, 127, 80, 255}},
+	{"gold", color.RGBA{255, 215, 0, 255}},
+	{"yellow", color.RGBA{255, 255, 0, 255}},
+	{"olive", color.RGBA{128, 128, 0, 255}},
+	{"lime", color.RGBA{0, 255, 0, 255}},
+	{"green", color.RGBA{0, 128, 0, 255}},
+	{"teal", color.RGBA{0, 128, 128, 255}},
+	{"cyan", color.RGBA{0, 255, 255, 255}},
+	{"turquoise", color.RGBA{64, 224, 208, 255}},
+	{"sky blue", color.RGBA{135, 206, 235, 255}},
+	{"blue", color.RGBA{0, 0, 255, 255}},
+	{"navy", color.RGBA{0, 0, 128, 255}},
+	{"purple", color.RGBA{128, 0, 128, 255}},
+	{"violet", color.RGBA{238, 130, 238, 255}},
+	{"magenta", color.RGBA{255, 0, 255, 255}},
+	{"pink", color.RGBA{255, 192, 203, 255}},
+	{"brown", color.RGBA{139, 69, 19, 255}},
+	{"tan", color.RGBA{210, 180, 140, 255}},
+	{"beige", color.RGBA{245, 245, 220, 255}},
+	{"khaki", color.RGBA{240, 230, 140, 255}},
+}
+
+// toLab converts a color to CIE L*a*b* (sRGB, D65 white point)
+func toLab(c color.Color) (l, a, b float64) {
+	r, g, bl, _ := color.NRGBAModel.Convert(c).RGBA()
+	lin := func(v uint32) float64 {
+		f := float64(v) / 0xffff
+		if f <= 0.04045 {
+			return f / 12.92
+		}
+		return math.Pow((f+0.055)/1.055, 2.4)
+	}
+	rl, gl, bll := lin(r), lin(g), lin(bl)
+	x := (0.4124*rl + 0.3576*gl + 0.1805*bll) / 0.95047
+	y := 0.2126*rl + 0.7152*gl + 0.0722*bll
+	z := (0.0193*rl + 0.1192*gl + 0.9505*bll) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// NearestColorName returns the name of the palette color closest to c in Lab space
+func NearestColorName(c color.Color) string {
+	l, a, b := toLab(c)
+	best, bestDist := "", math.Inf(1)
+	for _, n := range colorNames {
+		nl, na, nb := toLab(n.c)
+		if d := (l-nl)*(l-nl) + (a-na)*(a-na) + (b-nb)*(b-nb); d < bestDist {
+			best, bestDist = n.name, d
+		}
+	}
+	return best
+}
+
+// DominantColor returns the most common color in a normalized region of the image: pixels are
+// sampled on a grid, grouped into coarse buckets, and the largest bucket's mean is returned
+func (p *Processor) DominantColor(img image.Image, region types.Box) color.Color {
+	b := img.Bounds()
+	x0, y0, x1, y1 := boxToPixels(region, b.Dx(), b.Dy())
+	if region.W <= 0 || region.H <= 0 {
+		x0, y0, x1, y1 = 0, 0, b.Dx(), b.Dy()
+	}
+	step := maxInt(1, maxInt(x1-x0, y1-y0)/losslessSampleGrid)
+
+	type bucket struct{ r, g, b, n int }
+	buckets := map[int]*bucket{}
+	var top *bucket
+	for y := y0; y < y1; y += step {
+		for x := x0; x < x1; x += step {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			// 3 bits per channel keeps shading variations of one color together
+			key := int(c.R>>5)<<6 | int(c.G>>5)<<3 | int(c.B>>5)
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.r += int(c.R)
+			bk.g += int(c.G)
+			bk.b += int(c.B)
+			bk.n++
+			if top == nil || bk.n > top.n {
+				top = bk
+			}
+		}
+	}
+	if top == nil {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{R: uint8(top.r / top.n), G: uint8(top.g / top.n), B: uint8(top.b / top.n), A: 255}
+}
+
+// DominantColorName names the dominant color of a normalized region (see DominantColor)
+func (p *Processor) DominantColorName(img image.Image, region types.Box) string {
+	return NearestColorName(p.DominantColor(img, region))
+}
+
+// PaletteColor is one color of an extracted palette with the share of sampled pixels it stands for
+type PaletteColor struct {
+	Color  color.NRGBA
+	Weight float64 // 0-1, the weights of one palette sum to 1
+}
+
+// k-means settings for DominantColorsKMeans
+const (
+	kmeansMaxIterations = 20
+	kmeansSeed          = 1
+	kmeansChunk         = 2048 // samples assigned per goroutine
+)
+
+// DominantColorsKMeans clusters the pixels of a normalized region (an empty region means the
+// whole image) into up to k colors with k-means in Lab space, so distinct but close colors stay
+// apart where the buckets of DominantColor would merge them. Pixels are sampled on a grid and
+// mostly transparent ones are ignored; centers are seeded k-means++ style from a fixed seed, so
+// the result is deterministic. Each color is the mean of its cluster's pixels; the palette is
+// sorted by weight, largest first, and has fewer than k entries when there are fewer distinct colors.
+func (p *Processor) DominantColorsKMeans(img image.Image, region types.Box, k int) []PaletteColor {
+	if k <= 0 {
+		return nil
+	}
+	b := img.Bounds()
+	x0, y0, x1, y1 := boxToPixels(region, b.Dx(), b.Dy())
+	if region.W <= 0 || region.H <= 0 {
+		x0, y0, x1, y1 = 0, 0, b.Dx(), b.Dy()
+	}
+	step := maxInt(1, maxInt(x1-x0, y1-y0)/losslessSampleGrid)
+
+	type sample struct {
+		lab [3]float64
+		rgb color.NRGBA
+	}
+	var samples []sample
+	distinct := map[color.NRGBA]bool{}
+	for y := y0; y < y1; y += step {
+		for x := x0; x < x1; x += step {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			c.A = 255
+			l, a, bb := toLab(c)
+			samples = append(samples, sample{[3]float64{l, a, bb}, c})
+			distinct[c] = true
+		}
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+	k = minInt(k, len(distinct))
+
+	dist := func(u, v [3]float64) float64 {
+		d0, d1, d2 := u[0]-v[0], u[1]-v[1], u[2]-v[2]
+		return d0*d0 + d1*d1 + d2*d2
+	}
+
+	// k-means++ seeding: each further center is drawn with probability proportional to the
+	// squared distance from the nearest center chosen so far
+	rng := rand.New(rand.NewPCG(kmeansSeed, kmeansSeed))
+	centers := [][3]float64{samples[rng.IntN(len(samples))].lab}
+	nearest := make([]float64, len(samples))
+	for len(centers) < k {
+		var total float64
+		for i, s := range samples {
+			d := dist(s.lab, centers[0])
+			for _, c := range centers[1:] {
+				d = math.Min(d, dist(s.lab, c))
+			}
+			nearest[i] = d
+			total += d
+		}
+		if total == 0 {
+			break
+		}
+		target, pick := rng.Float64()*total, len(samples)-1
+		for i, d := range nearest {
+			if target -= d; target < 0 {
+				pick = i
+				break
+			}
+		}
+		centers = append(centers, samples[pick].lab)
+	}
+
+	// Lloyd iterations; the assignment step runs on chunks of samples in parallel
+	assign := make([]int, len(samples))
+	for i := range assign {
+		assign[i] = -1
+	}
+	for iter := 0; iter < kmeansMaxIterations; iter++ {
+		var changed atomic.Bool
+		var wg sync.WaitGroup
+		for start := 0; start < len(samples); start += kmeansChunk {
+			end := minInt(start+kmeansChunk, len(samples))
+			wg.Add(1)
+			go func(start, end int) {
+				defer wg.Done()
+				for i := start; i < end; i++ {
+					best, bestDist := 0, math.Inf(1)
+					for c, center := range centers {
+						if d := dist(samples[i].lab, center); d < bestDist {
+							best, bestDist = c, d
+						}
+					}
+					if assign[i] != best {
+						assign[i] = best
+						changed.Store(true)
+					}
+				}
+			}(start, end)
+		}
+		wg.Wait()
+		if !changed.Load() {
+			break
+		}
+
+		sums := make([][3]float64, len(centers))
+		counts := make([]int, len(centers))
+		for i, s := range samples {
+			c := assign[i]
+			sums[c][0] += s.lab[0]
+			sums[c][1] += s.lab[1]
+			sums[c][2] += s.lab[2]
+			counts[c]++
+		}
+		for c := range centers {
+			if counts[c] > 0 {
+				n := float64(counts[c])
+				centers[c] = [3]float64{sums[c][0] / n, sums[c][1] / n, sums[c][2] / n}
+			}
+		}
+	}
+
+	type cluster struct{ r, g, b, n int }
+	clusters := make([]cluster, len(centers))
+	for i, s := range samples {
+		cl := &clusters[assign[i]]
+		cl.r += int(s.rgb.R)
+		cl.g += int(s.rgb.G)
+		cl.b += int(s.rgb.B)
+		cl.n++
+	}
+	var palette []PaletteColor
+	for _, cl := range clusters {
+		if cl.n == 0 {
+			continue
+		}
+		palette = append(palette, PaletteColor{
+			Color:  color.NRGBA{R: uint8(cl.r / cl.n), G: uint8(cl.g / cl.n), B: uint8(cl.b / cl.n), A: 255},
+			Weight: float64(cl.n) / float64(len(samples)),
+		})
+	}
+	sort.SliceStable(palette, func(i, j int) bool { return palette[i].Weight > palette[j].Weight })
+	return palette
+}
+
+// Theme classification thresholds for ComputeTheme
+const (
+	themeDarkBrightness = 0.5  // below this perceived brightness an image is dark
+	themeVividChroma    = 0.25 // at or above this mean chroma an image is vivid
+)
+
+// ComputeTheme summarizes the whole image: its average color, perceived brightness (Rec. 709
+// luma) with a dark/light tone, and mean chroma with a vivid/muted mood. Pixels are sampled on
+// a grid and mostly transparent ones are ignored.
+func (p *Processor) ComputeTheme(img image.Image) types.Theme {
+	b := img.Bounds()
+	step := maxInt(1, maxInt(b.Dx(), b.Dy())/losslessSampleGrid)
+	var sr, sg, sb, luma, chroma float64
+	n := 0
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			r, g, bl := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+			sr, sg, sb = sr+r, sg+g, sb+bl
+			luma += 0.2126*r + 0.7152*g + 0.0722*bl
+			chroma += math.Max(r, math.Max(g, bl)) - math.Min(r, math.Min(g, bl))
+			n++
+		}
+	}
+	if n == 0 {
+		return types.Theme{Average: "#000000", Tone: "dark", Mood: "muted"}
+	}
+	fn := float64(n)
+	theme := types.Theme{
+		Average:    fmt.Sprintf("#%02x%02x%02x", uint8(sr/fn*255+0.5), uint8(sg/fn*255+0.5), uint8(sb/fn*255+0.5)),
+		Brightness: luma / fn,
+		Saturation: chroma / fn,
+		Tone:       "light",
+		Mood:       "muted",
+	}
+	if theme.Brightness < themeDarkBrightness {
+		theme.Tone = "dark"
+	}
+	if theme.Saturation >= themeVividChroma {
+		theme.Mood = "vivid"
+	}
+	return theme
+}
+
+// Helper functions
+func clamp(v, lo, hi float64) float64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
 }
 
 func minInt(a, b int) int {
@@ -310,6 +2872,13 @@ func minInt(a, b int) int {
 	return b
 }
 
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func boxToPixels(box types.Box, w, h int) (int, int, int, int) {
 	x0 := int(clamp(box.X, 0, 1)*float64(w) + 0.5)
 	y0 := int(clamp(box.Y, 0, 1)*float64(h) + 0.5)
@@ -0,0 +1,1094 @@
+package processing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+
+	"github.com/menta2k/image-analyzer/pkg/types"
+)
+
+// testImage returns a w x h gradient, so crops and decodes can be compared pixel by pixel
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), 128, 255})
+		}
+	}
+	return img
+}
+
+// writeEncoded encodes img as format into dir/name and returns the path
+func writeEncoded(t *testing.T, p *Processor, img image.Image, dir, name, format string) string {
+	t.Helper()
+	data, err := p.EncodeImage(img, format, 90, false)
+	if err != nil {
+		t.Fatalf("encode %s: %v", format, err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadImage(t *testing.T) {
+	p := NewProcessor()
+	dir := t.TempDir()
+	src := testImage(64, 48)
+	tests := []struct {
+		name   string
+		file   string
+		format string
+	}{
+		{"png", "a.png", "png"},
+		{"jpeg", "a.jpg", "jpg"},
+		{"webp", "a.webp", "webp"},
+		// Content decides the decoder, a wrong extension does not matter
+		{"png named webp", "b.webp", "png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeEncoded(t, p, src, dir, tt.file, tt.format)
+			img, err := p.LoadImage(path)
+			if err != nil {
+				t.Fatalf("LoadImage: %v", err)
+			}
+			if got := img.Bounds().Size(); got != src.Bounds().Size() {
+				t.Errorf("size = %v, want %v", got, src.Bounds().Size())
+			}
+		})
+	}
+}
+
+func TestLoadImageRejectsNonImages(t *testing.T) {
+	p := NewProcessor()
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"html", []byte("<!DOCTYPE html><html><body>not found</body></html>")},
+		{"garbage", bytes.Repeat([]byte{0x42}, 64)},
+		{"html with inline svg", []byte(`<!DOCTYPE html><html><body><svg xmlns="http://www.w3.org/2000/svg" width="8" height="8"><rect width="8" height="8"/></svg></body></html>`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".jpg")
+			if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.LoadImage(path); err == nil {
+				t.Fatal("LoadImage succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestIsSVG(t *testing.T) {
+	rect := `<svg xmlns="http://www.w3.org/2000/svg" width="8" height="8"><rect width="8" height="8"/></svg>`
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"bare", rect, true},
+		{"bom and whitespace", "\xef\xbb\xbf \n\t" + rect, true},
+		{"xml declaration", `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + rect, true},
+		{"doctype and comment", `<?xml version="1.0"?><!-- drawn by hand --><!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd">` + rect, true},
+		{"doctype with internal subset", `<!DOCTYPE svg [<!ENTITY ns "http://www.w3.org/2000/svg">] >` + rect, true},
+		{"html with inline svg", `<!DOCTYPE html><html><body>` + rect + `</body></html>`, false},
+		{"text mentioning svg", "see <svg> elements", false},
+		{"unterminated comment", "<!-- " + rect, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSVG([]byte(tt.data)); got != tt.want {
+				t.Errorf("isSVG = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// An HTML page must not slip past the non-image check on its inline <svg>
+	if err := checkImageContent([]byte(tests[5].data)); !errors.Is(err, ErrNotImage) {
+		t.Errorf("checkImageContent(html) = %v, want ErrNotImage", err)
+	}
+
+	// A prologue in front of the root element still rasterizes
+	img, err := NewProcessor().LoadImageFromBytes([]byte("\xef\xbb\xbf" + tests[3].data))
+	if err != nil {
+		t.Fatalf("LoadImageFromBytes: %v", err)
+	}
+	if img.Bounds().Dx() == 0 {
+		t.Error("empty raster")
+	}
+}
+
+// pngHeader returns a PNG signature and IHDR chunk declaring a w x h RGBA image, enough for DecodeConfig
+func pngHeader(w, h uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	out := append([]byte("\x89PNG\r\n\x1a\n"), 0, 0, 0, 13)
+	out = append(out, ihdr...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestPixelLimit(t *testing.T) {
+	p := NewProcessor()
+	p.MaxPixels = 100 * 100
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		maxSize image.Point // for successful decodes
+	}{
+		{"raster over limit", pngHeader(200, 200), true, image.Point{}},
+		{"raster at limit", mustEncode(t, p, testImage(100, 100), "png"), false, image.Pt(100, 100)},
+		{"svg over limit", []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="4000" height="2000"><rect width="4000" height="2000"/></svg>`), false, image.Pt(141, 70)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := p.LoadImageFromBytes(tt.data)
+			if tt.wantErr {
+				if !errors.Is(err, ErrImageTooLarge) {
+					t.Fatalf("err = %v, want ErrImageTooLarge", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := img.Bounds().Size(); got.X > tt.maxSize.X || got.Y > tt.maxSize.Y || got.X*got.Y > int(p.MaxPixels) {
+				t.Errorf("size = %v, want at most %v", got, tt.maxSize)
+			}
+		})
+	}
+}
+
+// mustEncode encodes img as format
+func mustEncode(t *testing.T, p *Processor, img image.Image, format string) []byte {
+	t.Helper()
+	data, err := p.EncodeImage(img, format, 90, false)
+	if err != nil {
+		t.Fatalf("encode %s: %v", format, err)
+	}
+	return data
+}
+
+// withEXIF inserts an EXIF APP1 segment declaring declW x declH, with thumb as the IFD1
+// thumbnail unless it is nil, right after the SOI marker of jpegData
+func withEXIF(jpegData []byte, declW, declH uint32, thumb []byte) []byte {
+	le := binary.LittleEndian
+	entry := func(b []byte, tag uint16, value uint32) []byte {
+		b = le.AppendUint16(b, tag)
+		b = le.AppendUint16(b, 4) // LONG
+		b = le.AppendUint32(b, 1)
+		return le.AppendUint32(b, value)
+	}
+	// Layout: header (8), IFD0 (18), Exif IFD (30), IFD1 (30), thumbnail
+	const ifd0, exifIFD, ifd1, thumbOff = 8, 26, 56, 86
+	t := append([]byte("II"), 0x2A, 0)
+	t = le.AppendUint32(t, ifd0)
+	t = le.AppendUint16(t, 1)
+	t = entry(t, 0x8769, exifIFD)
+	if thumb != nil {
+		t = le.AppendUint32(t, ifd1)
+	} else {
+		t = le.AppendUint32(t, 0)
+	}
+	t = le.AppendUint16(t, 2)
+	t = entry(t, 0xA002, declW)
+	t = entry(t, 0xA003, declH)
+	t = le.AppendUint32(t, 0)
+	if thumb != nil {
+		t = le.AppendUint16(t, 2)
+		t = entry(t, 0x0201, thumbOff)
+		t = entry(t, 0x0202, uint32(len(thumb)))
+		t = le.AppendUint32(t, 0)
+		t = append(t, thumb...)
+	}
+
+	seg := append([]byte("Exif\x00\x00"), t...)
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(seg)+2))
+	out = append(out, seg...)
+	return append(out, jpegData[2:]...)
+}
+
+func TestThumbnailOnly(t *testing.T) {
+	p := NewProcessor()
+	main := mustEncode(t, p, testImage(600, 400), "jpg")
+	thumb := mustEncode(t, p, testImage(120, 80), "jpg")
+	broken := withEXIF(main, 600, 400, thumb)
+	broken = broken[:len(broken)-len(main)/3]
+	// Declares far more pixels than the main image header, so only the upscale hits the limit
+	brokenHuge := withEXIF(main, 6000, 4000, thumb)
+	brokenHuge = brokenHuge[:len(brokenHuge)-len(main)/3]
+	tests := []struct {
+		name      string
+		data      []byte
+		configure func(p *Processor)
+		wantErr   error
+		wantSize  image.Point
+	}{
+		{"truncated", broken, nil, ErrThumbnailOnly, image.Point{}},
+		{"truncated allowed", broken, func(p *Processor) { p.AllowThumbnailOnly = true }, nil, image.Pt(600, 400)},
+		{"truncated allowed within pixel limit", brokenHuge, func(p *Processor) {
+			p.AllowThumbnailOnly = true
+			p.MaxPixels = 1200 * 800
+		}, nil, image.Pt(1200, 800)},
+		// Recovering part of the main image beats the thumbnail
+		{"truncated partial", broken, func(p *Processor) { p.AllowPartial = true }, nil, image.Pt(600, 400)},
+		// EXIF left stale by a resize is not damage
+		{"stale EXIF size", withEXIF(thumb, 6000, 4000, thumb), nil, nil, image.Pt(120, 80)},
+		{"no thumbnail", withEXIF(main, 600, 400, nil)[:len(main)/2], nil, nil, image.Point{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor()
+			if tt.configure != nil {
+				tt.configure(p)
+			}
+			img, err := p.LoadImageFromBytes(tt.data)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantSize == image.Point{}:
+				var unsupported *UnsupportedFormatError
+				if !errors.As(err, &unsupported) {
+					t.Fatalf("err = %v, want UnsupportedFormatError", err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			default:
+				if got := img.Bounds().Size(); got != tt.wantSize {
+					t.Errorf("size = %v, want %v", got, tt.wantSize)
+				}
+			}
+		})
+	}
+
+	// The file loader only sees the leading bytes when looking for the thumbnail
+	path := filepath.Join(t.TempDir(), "broken.jpg")
+	if err := os.WriteFile(path, broken, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.LoadImage(path); !errors.Is(err, ErrThumbnailOnly) {
+		t.Errorf("LoadImage err = %v, want ErrThumbnailOnly", err)
+	}
+}
+
+func TestDecodePartialJPEG(t *testing.T) {
+	p := NewProcessor()
+	src := testImage(320, 480)
+	// Noise spreads the scan data over the rows, so truncation lands mid-image
+	for i := range src.Pix {
+		if i%4 != 3 {
+			src.Pix[i] ^= uint8(i * 7919 >> 3)
+		}
+	}
+	data := mustEncode(t, p, src, "jpg")
+	ref, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first row a zero-padded decode gets wrong is where the real data ends
+	realRows := func(truncated []byte) int {
+		cfg, _ := jpeg.DecodeConfig(bytes.NewReader(truncated))
+		padded, err := decodePaddedJPEG(truncated, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < cfg.Height; y++ {
+			if !jpegRowsEqual(ref, padded, y) {
+				return y
+			}
+		}
+		return cfg.Height
+	}
+
+	for _, keep := range []int{3, 2} {
+		truncated := data[:len(data)*keep/4]
+		t.Run(fmt.Sprintf("%d/4", keep), func(t *testing.T) {
+			if _, err := NewProcessor().LoadImageFromBytes(truncated); err == nil {
+				t.Fatal("truncated JPEG decoded without AllowPartial")
+			}
+			p := NewProcessor()
+			p.AllowPartial = true
+			img, err := p.LoadImageFromBytes(truncated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := img.Bounds().Size(); got != src.Bounds().Size() {
+				t.Fatalf("size = %v, want %v", got, src.Bounds().Size())
+			}
+			firstGray := img.Bounds().Dy()
+			for y := 0; y < img.Bounds().Dy(); y++ {
+				if !jpegRowsEqual(img, ref, y) {
+					firstGray = y
+					break
+				}
+			}
+			for y := firstGray; y < img.Bounds().Dy(); y++ {
+				if c := color.GrayModel.Convert(img.At(0, y)).(color.Gray); c.Y < 120 || c.Y > 136 {
+					t.Fatalf("row %d after the recovered part is %v, want gray", y, c)
+				}
+			}
+			// Only the last, partly decoded MCU row may be lost
+			if want := realRows(truncated); firstGray < want-16 || firstGray > want {
+				t.Errorf("gray starts at row %d, real data ends at row %d", firstGray, want)
+			}
+		})
+	}
+}
+
+func TestEncodeImageFormats(t *testing.T) {
+	p := NewProcessor()
+	img := testImage(32, 24)
+	tests := []struct {
+		format string
+		want   string // sniffed format of the output, empty for an error
+	}{
+		{"jpg", "jpeg"},
+		{"JPEG", "jpeg"},
+		{"png", "png"},
+		{"webp", "webp"},
+		{"gif", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			data, err := p.EncodeImage(img, tt.format, 80, false)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("EncodeImage(%q) succeeded, want an error", tt.format)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sniffFormat(data); got != tt.want {
+				t.Errorf("output sniffs as %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindQuietRegionTinyImages(t *testing.T) {
+	p := NewProcessor()
+	tests := []struct {
+		name    string
+		w, h    int
+		subject types.Box
+		ratio   float64
+	}{
+		{"1x1", 1, 1, types.Box{}, 1},
+		{"thin column", 2, 300, types.Box{}, 1},
+		{"thin row", 300, 2, types.Box{X: 0, Y: 0, W: 0.1, H: 1}, 1},
+		{"thin row, wide ratio", 300, 2, types.Box{}, 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			box, err := p.FindQuietRegion(testImage(tt.w, tt.h), tt.subject, tt.ratio)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range []float64{box.X, box.Y, box.W, box.H} {
+				if math.IsNaN(v) || v < 0 || v > 1 {
+					t.Fatalf("box = %+v, want normalized coordinates", box)
+				}
+			}
+			if box.W <= 0 || box.H <= 0 {
+				t.Errorf("box = %+v, want a non-empty box", box)
+			}
+		})
+	}
+}
+
+func TestPoolBuffersVaryingSizes(t *testing.T) {
+	plain, pooled := NewProcessor(), NewProcessor()
+	pooled.PoolBuffers = true
+	box := types.Box{X: 0.2, Y: 0.2, W: 0.5, H: 0.5}
+	// Sizes repeat, so later overlays reuse released buffers holding other images
+	for i, size := range []image.Point{{64, 48}, {32, 32}, {64, 48}, {48, 64}, {32, 32}, {64, 48}} {
+		src := testImage(size.X, size.Y)
+		if i%2 == 1 {
+			src = imaging.FlipH(src)
+		}
+		want := plain.CreateDebugOverlay(src, box, box, 0.5, 0.5).(*image.NRGBA)
+		got := pooled.CreateDebugOverlay(src, box, box, 0.5, 0.5).(*image.NRGBA)
+		if got.Bounds() != want.Bounds() || !bytes.Equal(got.Pix, want.Pix) {
+			t.Fatalf("overlay %d (%v): pooled result differs from unpooled", i, size)
+		}
+		pooled.Release(got)
+	}
+}
+
+// BenchmarkDebugOverlay shows the allocations PoolBuffers saves on repeated same-size overlays
+func BenchmarkDebugOverlay(b *testing.B) {
+	src := testImage(1024, 768)
+	box := types.Box{X: 0.2, Y: 0.2, W: 0.5, H: 0.5}
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%v", pool), func(b *testing.B) {
+			p := NewProcessor()
+			p.PoolBuffers = pool
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p.Release(p.CreateDebugOverlay(src, box, box, 0.5, 0.5))
+			}
+		})
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	p := NewProcessor()
+	tests := []struct {
+		name    string
+		w, h    int
+		maxEdge int
+		want    image.Point
+	}{
+		{"landscape", 2000, 1000, 512, image.Pt(512, 256)},
+		{"portrait", 1000, 2000, 512, image.Pt(256, 512)},
+		{"square", 800, 800, 512, image.Pt(512, 512)},
+		{"no upscaling", 300, 200, 512, image.Pt(300, 200)},
+		{"disabled", 2000, 1000, 0, image.Pt(2000, 1000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Thumbnail(testImage(tt.w, tt.h), tt.maxEdge).Bounds().Size(); got != tt.want {
+				t.Errorf("size = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// checkerboard returns a w x h black and white board of size x size squares
+func checkerboard(w, h, size int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{255, 255, 255, 255}
+			if (x/size+y/size)%2 == 0 {
+				c = color.NRGBA{0, 0, 0, 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestDeskew(t *testing.T) {
+	p := NewProcessor()
+	board := checkerboard(800, 600, 50)
+	tests := []struct {
+		name     string
+		tilt     float64 // counter-clockwise rotation applied to the board
+		maxAngle float64
+		want     float64 // expected correction
+	}{
+		{"level", 0, 5, 0},
+		{"tilted 3", 3, 5, -3},
+		{"tilted -2.5", -2.5, 5, 2.5},
+		{"tilted 1.7", 1.7, 5, -1.7},
+		{"beyond the limit", 8, 4, -4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.Image(board)
+			if tt.tilt != 0 {
+				img = imaging.CropCenter(imaging.Rotate(board, tt.tilt, color.Gray{128}), 700, 500)
+			}
+			out, angle := p.Deskew(img, tt.maxAngle)
+			// Tilts on the 0.1 degree search grid are recovered exactly
+			if math.Abs(angle-tt.want) > 1e-9 {
+				t.Errorf("angle = %.2f, want %.2f", angle, tt.want)
+			}
+			if tt.want == -tt.tilt {
+				if _, again := p.Deskew(out, tt.maxAngle); again != 0 {
+					t.Errorf("straightened image is still tilted by %.2f", again)
+				}
+			}
+			if math.Abs(angle) > tt.maxAngle {
+				t.Errorf("angle %.2f exceeds the limit %.1f", angle, tt.maxAngle)
+			}
+			if angle == 0 && out != img {
+				t.Error("unrotated image was copied")
+			}
+		})
+	}
+}
+
+// noiseImage returns a w x h image of deterministic noise, which compresses poorly at every quality
+func noiseImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	state := uint32(1)
+	for i := range img.Pix {
+		state = state*1664525 + 1013904223
+		img.Pix[i] = uint8(state >> 24)
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+func TestEncodeToTargetSize(t *testing.T) {
+	p := NewProcessor()
+	img := noiseImage(128, 128)
+	for _, format := range []string{"jpg", "webp"} {
+		t.Run(format, func(t *testing.T) {
+			high, err := p.EncodeImage(img, format, 95, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			low, err := p.EncodeImage(img, format, 10, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A cap between the two sizes needs a quality between the two
+			maxBytes := int64(len(low)+len(high)) / 2
+			data, q, err := p.EncodeToTargetSize(img, format, maxBytes)
+			if err != nil {
+				t.Fatalf("EncodeToTargetSize(%d): %v", maxBytes, err)
+			}
+			if int64(len(data)) > maxBytes || q <= 10 || q >= 95 {
+				t.Errorf("%d bytes at quality %d, want at most %d bytes at a quality in (10, 95)", len(data), q, maxBytes)
+			}
+			if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+				t.Errorf("result does not decode: %v", err)
+			}
+
+			// A cap nothing fits under returns the minimum quality with an error
+			data, q, err = p.EncodeToTargetSize(img, format, 100)
+			if err == nil || q != minTargetQuality || len(data) == 0 {
+				t.Errorf("tiny cap: %d bytes at quality %d, err %v; want quality %d bytes and an error", len(data), q, err, minTargetQuality)
+			}
+		})
+	}
+
+	if _, _, err := p.EncodeToTargetSize(img, "jpg", 0); err == nil {
+		t.Error("a zero cap was accepted")
+	}
+	// PNG is lossless, so the one encode either fits or not
+	if _, q, err := p.EncodeToTargetSize(testImage(32, 32), "png", 1<<20); err != nil || q != maxTargetQuality {
+		t.Errorf("png under a large cap: quality %d, err %v", q, err)
+	}
+	if _, _, err := p.EncodeToTargetSize(img, "png", 100); err == nil {
+		t.Error("png over the cap succeeded")
+	}
+}
+
+// maxEdgeGradient returns the largest difference between horizontal neighbours in the middle row's red channel
+func maxEdgeGradient(img image.Image) int {
+	n := imaging.Clone(img)
+	y := n.Rect.Dy() / 2
+	best := 0
+	for x := 0; x+1 < n.Rect.Dx(); x++ {
+		d := int(n.Pix[y*n.Stride+(x+1)*4]) - int(n.Pix[y*n.Stride+x*4])
+		if d < 0 {
+			d = -d
+		}
+		if d > best {
+			best = d
+		}
+	}
+	return best
+}
+
+func TestSharpen(t *testing.T) {
+	p := NewProcessor()
+	// A soft vertical edge, as left by downscaling
+	edge := imaging.New(64, 64, color.NRGBA{60, 60, 60, 255})
+	edge = imaging.Paste(edge, imaging.New(32, 64, color.NRGBA{190, 190, 190, 255}), image.Pt(32, 0))
+	soft := imaging.Blur(edge, 2)
+
+	base := maxEdgeGradient(soft)
+	light := maxEdgeGradient(p.Sharpen(soft, 1, 1))
+	strong := maxEdgeGradient(p.Sharpen(soft, 1, 2))
+	if light <= base || strong <= light {
+		t.Errorf("edge gradient: soft %d, sharpened %d, amount 2 %d; want strictly increasing", base, light, strong)
+	}
+	if got := p.Sharpen(soft, 0, 1); got != image.Image(soft) {
+		t.Error("sigma 0 did not return the image unchanged")
+	}
+
+	// PostSharpen applies after the resize to the crop size
+	cfg := types.CropConfig{Width: 32, Height: 32}
+	box := types.Box{X: 0.25, Y: 0.25, W: 0.5, H: 0.5}
+	plain, err := p.CropImageWithConfig(soft, box, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PostSharpen = 1
+	sharp, err := p.CropImageWithConfig(soft, box, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sharp.Bounds().Size() != image.Pt(32, 32) || maxEdgeGradient(sharp) <= maxEdgeGradient(plain) {
+		t.Errorf("PostSharpen crop is %v with gradient %d, plain crop has %d", sharp.Bounds().Size(), maxEdgeGradient(sharp), maxEdgeGradient(plain))
+	}
+}
+
+func TestPackAtlas(t *testing.T) {
+	p := NewProcessor()
+	crops := map[string]image.Image{
+		"a": imaging.New(60, 40, color.NRGBA{255, 0, 0, 255}),
+		"b": imaging.New(50, 30, color.NRGBA{0, 255, 0, 255}),
+		"c": imaging.New(40, 20, color.NRGBA{0, 0, 255, 255}),
+		"d": imaging.New(100, 10, color.NRGBA{255, 255, 0, 255}),
+	}
+	atlas, rects, err := p.PackAtlas(crops, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rects) != len(crops) {
+		t.Fatalf("got %d rectangles for %d images", len(rects), len(crops))
+	}
+	bounds := atlas.Bounds()
+	if bounds.Dx() > 120 {
+		t.Errorf("atlas is %dpx wide, want at most 120", bounds.Dx())
+	}
+	for name, r := range rects {
+		if r.Size() != crops[name].Bounds().Size() {
+			t.Errorf("%s: rectangle %v, image is %v", name, r.Size(), crops[name].Bounds().Size())
+		}
+		if !r.In(bounds) {
+			t.Errorf("%s: rectangle %v outside the atlas %v", name, r, bounds)
+		}
+		for other, o := range rects {
+			if other != name && r.Overlaps(o) {
+				t.Errorf("%s %v overlaps %s %v", name, r, other, o)
+			}
+		}
+		// The atlas holds each image's pixels at its rectangle
+		want := crops[name].At(0, 0)
+		if got := color.NRGBAModel.Convert(atlas.At(r.Min.X, r.Min.Y)); got != want {
+			t.Errorf("%s: atlas pixel %v, want %v", name, got, want)
+		}
+	}
+
+	if _, _, err := p.PackAtlas(crops, 80); err == nil {
+		t.Error("an image wider than the atlas was accepted")
+	}
+	if _, _, err := p.PackAtlas(nil, 120); err == nil {
+		t.Error("an empty map was accepted")
+	}
+	if _, _, err := p.PackAtlas(crops, 0); err == nil {
+		t.Error("a zero width was accepted")
+	}
+}
+
+func TestToGrayscale(t *testing.T) {
+	p := NewProcessor()
+	rect := image.Rect(0, 0, 2, 2)
+	nrgba := image.NewNRGBA(rect)
+	rgba := image.NewRGBA(rect)
+	ycc := image.NewYCbCr(rect, image.YCbCrSubsampleRatio444)
+	pal := image.NewPaletted(rect, color.Palette{color.NRGBA{255, 0, 0, 255}})
+	gray16 := image.NewGray16(rect)
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			nrgba.Set(x, y, color.NRGBA{255, 0, 0, 255})
+			rgba.Set(x, y, color.RGBA{255, 0, 0, 255})
+			gray16.Set(x, y, color.Gray16{0x8080})
+		}
+	}
+	yy, cb, cr := color.RGBToYCbCr(255, 0, 0)
+	for i := range ycc.Y {
+		ycc.Y[i], ycc.Cb[i], ycc.Cr[i] = yy, cb, cr
+	}
+
+	// Rec. 709 puts pure red at 0.2126 * 255 = 54
+	for name, tc := range map[string]struct {
+		img  image.Image
+		want uint8
+		tol  int
+	}{
+		"nrgba":    {nrgba, 54, 0},
+		"rgba":     {rgba, 54, 0},
+		"paletted": {pal, 54, 0},
+		"ycbcr":    {ycc, 54, 2}, // the YCbCr round trip is lossy
+		"gray16":   {gray16, 0x80, 0},
+	} {
+		g := p.ToGrayscale(tc.img)
+		if g.Bounds().Size() != rect.Size() {
+			t.Errorf("%s: size %v, want %v", name, g.Bounds().Size(), rect.Size())
+			continue
+		}
+		got := g.GrayAt(g.Bounds().Min.X+1, g.Bounds().Min.Y+1).Y
+		if d := int(got) - int(tc.want); d < -tc.tol || d > tc.tol {
+			t.Errorf("%s: gray %d, want %d", name, got, tc.want)
+		}
+	}
+}
+
+func TestUnsupportedFormatError(t *testing.T) {
+	p := NewProcessor()
+	// An ISO-BMFF header with a heic brand, which no registered decoder reads
+	heic := append([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), make([]byte, 64)...)
+	path := filepath.Join(t.TempDir(), "photo.heic")
+	if err := os.WriteFile(path, heic, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := p.LoadImage(path)
+	var ufe *UnsupportedFormatError
+	if !errors.As(err, &ufe) {
+		t.Fatalf("LoadImage: %v is not an UnsupportedFormatError", err)
+	}
+	if ufe.Format != "heic" || ufe.Path != path {
+		t.Errorf("LoadImage: format %q path %q, want heic and %s", ufe.Format, ufe.Path, path)
+	}
+	if err.Error() != "image: unknown format for "+path {
+		t.Errorf("LoadImage message changed: %q", err)
+	}
+
+	_, err = p.LoadImageFromBytes([]byte("8BPS\x00\x01 not really a psd"))
+	if !errors.As(err, &ufe) || ufe.Format != "psd" || ufe.Path != "" {
+		t.Errorf("LoadImageFromBytes: %v, want an UnsupportedFormatError for psd", err)
+	}
+}
+
+// lumaRange returns the spread of gray levels inside r
+func lumaRange(g *image.Gray, r image.Rectangle) int {
+	lo, hi := 255, 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := int(g.GrayAt(x, y).Y)
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+	}
+	return hi - lo
+}
+
+func TestCLAHE(t *testing.T) {
+	p := NewProcessor()
+	// A faint texture in the dark left half, next to a bright right half
+	img := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			v := uint8(200)
+			if x < 64 {
+				v = uint8(30 + (x/4+y/4)%2*8)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	dark := image.Rect(8, 8, 56, 120)
+
+	before := lumaRange(p.ToGrayscale(img), dark)
+	out := p.CLAHE(img, 8, 4)
+	if out.Bounds().Size() != img.Bounds().Size() {
+		t.Fatalf("size %v, want %v", out.Bounds().Size(), img.Bounds().Size())
+	}
+	after := lumaRange(p.ToGrayscale(out), dark)
+	if after <= 2*before {
+		t.Errorf("local contrast in the dark half went from %d to %d, want it at least doubled", before, after)
+	}
+
+	// A flat image has nothing to stretch
+	flat := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := range flat.Pix {
+		flat.Pix[i] = 100
+	}
+	if r := lumaRange(p.ToGrayscale(p.CLAHE(flat, 3, 4)), flat.Rect); r != 0 {
+		t.Errorf("flat image gained a range of %d", r)
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	p := &Processor{AllowedHosts: []string{"images.example.com", ".cdn.example.net"}}
+	for raw, ok := range map[string]bool{
+		"https://images.example.com/a.jpg":     true,
+		"https://IMAGES.example.com./a.jpg":    true,
+		"http://images.example.com:8080/a.jpg": true,
+		"https://cdn.example.net/a.jpg":        true,
+		"https://eu.cdn.example.net/a.jpg":     true,
+		"https://example.com/a.jpg":            false,
+		"https://images.example.com.evil/a":    false,
+		"https://evilcdn.example.net/a.jpg":    false,
+		"http://127.0.0.1/a.jpg":               false,
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.checkHost(u)
+		if ok && err != nil {
+			t.Errorf("%s: %v", raw, err)
+		}
+		if !ok && !errors.Is(err, ErrBlockedHost) {
+			t.Errorf("%s: got %v, want ErrBlockedHost", raw, err)
+		}
+	}
+	if err := (&Processor{}).checkHost(&url.URL{Host: "anything.internal"}); err != nil {
+		t.Errorf("empty allow-list refused a host: %v", err)
+	}
+}
+
+func TestCheckDialAddress(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"93.184.216.34:443":           true,
+		"[2606:2800:220:1::1]:443":    true,
+		"127.0.0.1:80":                false,
+		"10.1.2.3:80":                 false,
+		"172.16.0.1:80":               false,
+		"192.168.1.1:80":              false,
+		"169.254.169.254:80":          false,
+		"100.64.0.1:80":               false,
+		"0.0.0.0:80":                  false,
+		"224.0.0.1:80":                false,
+		"[::1]:80":                    false,
+		"[fc00::1]:80":                false,
+		"[fe80::1]:80":                false,
+		"[::ffff:127.0.0.1]:80":       false,
+		"[::ffff:169.254.169.254]:80": false,
+		"not-an-address":              false,
+	} {
+		err := checkDialAddress("tcp", addr, nil)
+		if ok && err != nil {
+			t.Errorf("%s: %v", addr, err)
+		}
+		if !ok && !errors.Is(err, ErrBlockedHost) {
+			t.Errorf("%s: got %v, want ErrBlockedHost", addr, err)
+		}
+	}
+}
+
+func TestLoadImageFromURLBlocking(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://localhost.localdomain/a.png", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, testImage(8, 8))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	// The test server listens on loopback, which BlockPrivateNetworks refuses
+	_, err := (&Processor{BlockPrivateNetworks: true}).LoadImageFromURL(srv.URL + "/a.png")
+	if !errors.Is(err, ErrBlockedHost) {
+		t.Errorf("loopback with BlockPrivateNetworks: got %v, want ErrBlockedHost", err)
+	}
+
+	p := &Processor{AllowedHosts: []string{u.Hostname()}}
+	if img, err := p.LoadImageFromURL(srv.URL + "/a.png"); err != nil || img.Bounds().Dx() != 8 {
+		t.Errorf("allowed host: %v", err)
+	}
+	if _, err := p.LoadImageFromURL(srv.URL + "/redirect"); !errors.Is(err, ErrBlockedHost) {
+		t.Errorf("redirect to another host: got %v, want ErrBlockedHost", err)
+	}
+	if _, err := (&Processor{AllowedHosts: []string{"example.com"}}).LoadImageFromURL(srv.URL + "/a.png"); !errors.Is(err, ErrBlockedHost) {
+		t.Errorf("host outside the allow-list: got %v, want ErrBlockedHost", err)
+	}
+}
+
+func TestDominantColorsKMeans(t *testing.T) {
+	p := NewProcessor()
+	// Vertical bands: half red, 30% green, 20% blue
+	colors := []color.NRGBA{{220, 30, 30, 255}, {30, 200, 60, 255}, {40, 60, 210, 255}}
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 100; x++ {
+			c := colors[0]
+			if x >= 80 {
+				c = colors[2]
+			} else if x >= 50 {
+				c = colors[1]
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	for _, k := range []int{3, 5} {
+		palette := p.DominantColorsKMeans(img, types.Box{}, k)
+		if len(palette) != 3 {
+			t.Fatalf("k=%d: %d colors, want 3", k, len(palette))
+		}
+		for i, want := range []float64{0.5, 0.3, 0.2} {
+			pc := palette[i]
+			if math.Abs(pc.Weight-want) > 0.05 {
+				t.Errorf("k=%d: color %d weight %.3f, want about %.1f", k, i, pc.Weight, want)
+			}
+			if pc.Color != colors[i] {
+				t.Errorf("k=%d: color %d is %v, want %v", k, i, pc.Color, colors[i])
+			}
+		}
+	}
+
+	// A region inside one band has a single color
+	palette := p.DominantColorsKMeans(img, types.Box{X: 0.55, Y: 0.1, W: 0.2, H: 0.8}, 3)
+	if len(palette) != 1 || palette[0].Color != colors[1] || palette[0].Weight != 1 {
+		t.Errorf("green region: %v, want only %v", palette, colors[1])
+	}
+	if palette := p.DominantColorsKMeans(img, types.Box{}, 0); palette != nil {
+		t.Errorf("k=0: %v, want nil", palette)
+	}
+}
+
+// samePixels reports whether two images have the same size and pixels
+func samePixels(a, b image.Image) bool {
+	na, nb := imaging.Clone(a), imaging.Clone(b)
+	if na.Rect != nb.Rect {
+		return false
+	}
+	for i := range na.Pix {
+		if na.Pix[i] != nb.Pix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCropImageToPixelBox(t *testing.T) {
+	p := NewProcessor()
+	img := testImage(100, 80)
+	box := types.Box{X: 0.1, Y: 0.2, W: 0.5, H: 0.4}
+	rect := image.Rect(10, 16, 60, 48)
+	for _, size := range []image.Point{{0, 0}, {40, 30}} {
+		byBox, err := p.CropImageToBox(img, box, size.X, size.Y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byPixels, err := p.CropImageToPixelBox(img, rect, size.X, size.Y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !samePixels(byBox, byPixels) {
+			t.Errorf("%v: normalized and pixel crops differ (%v vs %v)", size, byBox.Bounds(), byPixels.Bounds())
+		}
+	}
+
+	// Pixel rectangles are relative to the image's top-left corner, also for sub-images
+	sub := img.SubImage(image.Rect(20, 10, 100, 80))
+	got, err := p.CropImageToPixelBox(sub, image.Rect(0, 0, 10, 10), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePixels(got, imaging.Crop(img, image.Rect(20, 10, 30, 20))) {
+		t.Error("sub-image crop is not taken from the sub-image's corner")
+	}
+	// Out-of-range rectangles are clamped, and nothing left is an error
+	if got, err := p.CropImageToPixelBox(img, image.Rect(90, 70, 200, 200), 0, 0); err != nil || got.Bounds().Size() != image.Pt(10, 10) {
+		t.Errorf("clamped crop: %v, %v", got, err)
+	}
+	if _, err := p.CropImageToPixelBox(img, image.Rect(120, 0, 140, 10), 0, 0); err == nil {
+		t.Error("a rectangle outside the image was accepted")
+	}
+}
+
+func TestTagSRGB(t *testing.T) {
+	img := testImage(32, 24)
+	plain := NewProcessor()
+	tagged := NewProcessor()
+	tagged.TagSRGB = true
+
+	// PNG: an sRGB chunk right after IHDR, pixels unchanged
+	data, err := tagged.EncodeImage(img, "png", 90, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 33+13 || string(data[33+4:33+8]) != "sRGB" {
+		t.Fatalf("no sRGB chunk after IHDR")
+	}
+	if bytes.Count(data, []byte("sRGB")) != 1 {
+		t.Error("more than one sRGB chunk")
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("tagged PNG does not decode: %v", err)
+	}
+	if !samePixels(decoded, img) {
+		t.Error("tagged PNG pixels differ from the source")
+	}
+
+	// JPEG: an APP2 ICC profile right after SOI, same pixels as an untagged encode
+	data, err = tagged.EncodeImage(img, "jpg", 90, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[2] != 0xFF || data[3] != 0xE2 || !bytes.HasPrefix(data[6:], []byte("ICC_PROFILE\x00\x01\x01")) {
+		t.Fatalf("no ICC APP2 segment after SOI")
+	}
+	segLen := int(binary.BigEndian.Uint16(data[4:]))
+	profile := data[6+14 : 4+segLen]
+	if int(binary.BigEndian.Uint32(profile)) != len(profile) || string(profile[36:40]) != "acsp" {
+		t.Errorf("ICC profile header: size %d for %d bytes, signature %q", binary.BigEndian.Uint32(profile), len(profile), profile[36:40])
+	}
+	decoded, err = jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("tagged JPEG does not decode: %v", err)
+	}
+	untagged, err := plain.EncodeImage(img, "jpg", 90, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := jpeg.Decode(bytes.NewReader(untagged))
+	if !samePixels(decoded, want) {
+		t.Error("tagged JPEG pixels differ from an untagged encode")
+	}
+
+	// WebP is left alone
+	webpTagged, err := tagged.EncodeImage(img, "webp", 90, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webpPlain, _ := plain.EncodeImage(img, "webp", 90, false)
+	if !bytes.Equal(webpTagged, webpPlain) {
+		t.Error("TagSRGB changed WebP output")
+	}
+}
+
+func TestAnchoredCropSourceRect(t *testing.T) {
+	p := NewProcessor()
+	img := testImage(640, 480)
+	sizes := []image.Point{{200, 200}, {300, 100}, {120, 240}}
+	crops, err := p.CropToSizesAnchored(img, 0.7, 0.4, sizes, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range crops {
+		if c.SourceRect != PixelRect(c.Box, 640, 480) || c.SourceRect.Empty() || !c.SourceRect.In(img.Rect) {
+			t.Errorf("%dx%d: SourceRect %v for box %+v", c.Width, c.Height, c.SourceRect, c.Box)
+			continue
+		}
+		// Cropping SourceRect reproduces the crop exactly
+		again, err := p.CropImageToPixelBox(img, c.SourceRect, c.Width, c.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !samePixels(again, c.Image) {
+			t.Errorf("%dx%d: cropping SourceRect %v does not reproduce the crop", c.Width, c.Height, c.SourceRect)
+		}
+	}
+}
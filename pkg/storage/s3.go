@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records spans for uploads; it is a no-op unless an OpenTelemetry provider is installed
+var tracer = otel.Tracer("github.com/menta2k/image-analyzer/pkg/storage")
+
+// DefaultS3Timeout bounds each upload
+const DefaultS3Timeout = 60 * time.Second
+
+// DefaultS3Region is used when neither the config nor the environment names a region
+const DefaultS3Region = "us-east-1"
+
+// S3Config describes an S3 or S3-compatible bucket to upload to
+type S3Config struct {
+	Bucket string
+	Prefix string // prepended to every key, e.g. "crops/2024"
+	Region string // empty = DefaultS3Region
+	// Endpoint is the server URL, e.g. http://localhost:9000 for MinIO; empty = AWS for Region
+	Endpoint string
+	// PathStyle puts the bucket in the URL path instead of the host name, which most
+	// S3-compatible servers expect; always used for bucket names containing dots
+	PathStyle bool
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // for temporary credentials, optional
+}
+
+// ParseS3URL splits an s3://bucket/prefix URL into its bucket and prefix
+func ParseS3URL(s string) (bucket, prefix string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("%q is not an s3://bucket/prefix URL", s)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// S3ConfigFromEnv builds a config for bucket and prefix from the standard AWS environment:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION (or
+// AWS_DEFAULT_REGION) and AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL). A custom endpoint
+// switches to path-style addressing.
+func S3ConfigFromEnv(bucket, prefix string) S3Config {
+	cfg := S3Config{
+		Bucket:          bucket,
+		Prefix:          prefix,
+		Region:          firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		Endpoint:        firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	cfg.PathStyle = cfg.Endpoint != ""
+	return cfg
+}
+
+// firstEnv returns the first non-empty environment variable of names
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// S3Sink uploads each key as an object with a single signed (SigV4) PUT request
+type S3Sink struct {
+	cfg        S3Config
+	base       *url.URL
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewS3Sink creates a sink uploading to the configured bucket
+func NewS3Sink(cfg S3Config) (*S3Sink, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("no bucket")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no credentials (set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	}
+	if cfg.Region == "" {
+		cfg.Region = DefaultS3Region
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	// A dotted bucket name as a host name does not match the *.s3 wildcard TLS certificate
+	if strings.Contains(cfg.Bucket, ".") {
+		cfg.PathStyle = true
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("endpoint %q must be an http or https URL", endpoint)
+	}
+	if !cfg.PathStyle {
+		base.Host = cfg.Bucket + "." + base.Host
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	if cfg.PathStyle {
+		base.Path += "/" + cfg.Bucket
+	}
+
+	return &S3Sink{
+		cfg:        cfg,
+		base:       base,
+		httpClient: &http.Client{Timeout: DefaultS3Timeout},
+		now:        time.Now,
+	}, nil
+}
+
+// objectKey returns the full object key for key, including the prefix
+func (s *S3Sink) objectKey(key string) string {
+	key = strings.TrimLeft(key, "/")
+	if s.cfg.Prefix == "" {
+		return key
+	}
+	return s.cfg.Prefix + "/" + key
+}
+
+// URL returns the s3:// URL key is stored at
+func (s *S3Sink) URL(key string) string {
+	return "s3://" + s.cfg.Bucket + "/" + s.objectKey(key)
+}
+
+// Put uploads data as the object prefix/key, aborting the request when ctx is done
+func (s *S3Sink) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	objectKey := s.objectKey(key)
+	ctx, span := tracer.Start(ctx, "storage.s3.put", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("bucket", s.cfg.Bucket),
+			attribute.String("key", objectKey),
+			attribute.Int("bytes", len(data)),
+		))
+	defer span.End()
+
+	u := *s.base
+	u.Path += "/" + objectKey
+	u.RawPath = uriEncodePath(u.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("s3 put %s: %v", objectKey, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+	s.sign(req, data)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("s3 put %s: %v", objectKey, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("s3 put %s: %s: %s", objectKey, resp.Status, strings.TrimSpace(string(body)))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to req, signing the host and every header
+// already set on it
+func (s *S3Sink) sign(req *http.Request, payload []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncodePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// uriEncodePath percent-encodes everything in path except unreserved characters and "/",
+// as SigV4 expects (url.URL.EscapedPath leaves characters like "$" and "+" as they are)
+func uriEncodePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sha256Hex returns the lowercase hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewS3SinkAddressing(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      S3Config
+		wantBase string
+	}{
+		{"virtual host", S3Config{Bucket: "media", Region: "eu-west-1"}, "https://media.s3.eu-west-1.amazonaws.com"},
+		{"path style", S3Config{Bucket: "media", Endpoint: "http://localhost:9000", PathStyle: true}, "http://localhost:9000/media"},
+		// Dotted names would not match the wildcard certificate as a host name
+		{"dotted bucket", S3Config{Bucket: "media.example.com"}, "https://s3.us-east-1.amazonaws.com/media.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.AccessKeyID, tt.cfg.SecretAccessKey = "id", "secret"
+			s, err := NewS3Sink(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.base.String(); got != tt.wantBase {
+				t.Errorf("base = %q, want %q", got, tt.wantBase)
+			}
+		})
+	}
+}
+
+func TestS3SinkPut(t *testing.T) {
+	type request struct {
+		path, contentType, body string
+	}
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = append(got, request{r.URL.Path, r.Header.Get("Content-Type"), string(body)})
+	}))
+	defer srv.Close()
+
+	s, err := NewS3Sink(S3Config{
+		Bucket: "media.example.com", Prefix: "/crops/", Endpoint: srv.URL,
+		AccessKeyID: "id", SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(context.Background(), "dog/001.jpg", []byte("jpeg"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	want := request{"/media.example.com/crops/dog/001.jpg", "image/jpeg", "jpeg"}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("requests = %+v, want [%+v]", got, want)
+	}
+
+	// A done context stops the upload before it is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Put(ctx, "dog/002.jpg", []byte("jpeg"), "image/jpeg"); err == nil {
+		t.Error("Put with a canceled context succeeded")
+	}
+	if len(got) != 1 {
+		t.Errorf("%d requests after cancellation, want 1", len(got))
+	}
+}
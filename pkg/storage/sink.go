@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// OutputSink stores output files (crops, overlays, sidecars) under slash-separated keys;
+// Put gives up when ctx is done
+type OutputSink interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+}
+
+// DirSink writes each key as a file below Root, creating directories as needed;
+// an empty Root treats keys as paths relative to the working directory
+type DirSink struct {
+	Root string
+}
+
+// NewDirSink creates a sink writing below root
+func NewDirSink(root string) *DirSink {
+	return &DirSink{Root: root}
+}
+
+// Put writes data to Root/key; the content type is not recorded
+func (s *DirSink) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := filepath.Join(s.Root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create directory for %s: %v", path, err)
+	}
+	return os.WriteFile(path, data, 0o644)
+}
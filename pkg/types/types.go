@@ -1,5 +1,7 @@
 package types
 
+import "image/color"
+
 // Box represents a normalized bounding box with coordinates in [0,1] range
 type Box struct {
 	X float64 `json:"x"`
@@ -19,18 +21,67 @@ type Primary struct {
 
 // AnalysisResult contains the complete analysis result from the vision model
 type AnalysisResult struct {
-	Primary     Primary  `json:"primary"`
-	Description string   `json:"description"`
-	Tags        []string `json:"tags"`
+	Primary     Primary   `json:"primary"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	Detections  []Primary `json:"detections,omitempty"` // every localized object, when requested
+	Theme       *Theme    `json:"theme,omitempty"`      // computed locally from the pixels, not by the model
+}
+
+// Theme summarizes an image's overall colors, e.g. for picking UI accent colors
+type Theme struct {
+	Average    string  `json:"average"`    // mean color as #rrggbb
+	Brightness float64 `json:"brightness"` // perceived brightness, 0 (black) to 1 (white)
+	Tone       string  `json:"tone"`       // "dark" or "light"
+	Saturation float64 `json:"saturation"` // mean chroma, 0 (gray) to 1 (pure colors)
+	Mood       string  `json:"mood"`       // "vivid" or "muted"
 }
 
+// CropAnchor selects where in the crop the subject center is placed
+type CropAnchor string
+
+const (
+	AnchorCenter CropAnchor = "center" // subject center in the middle of the crop
+	AnchorThirds CropAnchor = "thirds" // nearest rule-of-thirds intersection
+	AnchorGolden CropAnchor = "golden" // nearest golden-ratio intersection (0.382/0.618)
+	// AnchorPortrait puts the eye line of a face/person on the upper third with headroom above
+	AnchorPortrait CropAnchor = "portrait"
+)
+
+// CropMode selects whether a crop cuts the image or pads it to the target ratio
+type CropMode string
+
+const (
+	CropModeCrop CropMode = "crop" // cut the image to the crop box (default)
+	CropModePad  CropMode = "pad"  // keep the whole image, resized to fit and padded
+	CropModeAuto CropMode = "auto" // pad when cropping would discard more than MaxCropLoss
+)
+
+// DefaultMaxCropLoss is the share of the image CropModeAuto may crop away before padding instead
+const DefaultMaxCropLoss = 0.3
+
 // CropConfig defines the configuration for image cropping
 type CropConfig struct {
-	Width     int
-	Height    int
-	Quality   int
-	Lossless  bool
-	Extension string
+	Width       int
+	Height      int
+	Quality     int
+	Lossless    bool
+	Extension   string
+	PostSharpen float64 // unsharp mask sigma applied after resizing, 0 = off
+	// FullFrameSubjectThreshold is the fraction of the image area the subject box must cover
+	// for the whole image to be resized and padded instead of cropped, 0 = always crop
+	FullFrameSubjectThreshold float64
+	Subject                   Box        // detected subject box, used by FullFrameSubjectThreshold
+	Anchor                    CropAnchor // subject placement inside the crop, empty = AnchorCenter
+	// SnapToEven rounds the crop rectangle's pixel width and height to even numbers (for video
+	// encoders); only the source rectangle is snapped, an explicit Width/Height is used as given
+	SnapToEven bool
+	// Mode chooses between cropping and padding, empty = CropModeCrop
+	Mode CropMode
+	// MaxCropLoss is the fraction of the image area CropModeAuto may discard, 0 = DefaultMaxCropLoss
+	MaxCropLoss float64
+	// Background fills the padding of padded outputs, nil = the processor's PadColor
+	Background color.Color
 }
 
 // ProcessingOptions contains options for image processing
@@ -39,4 +90,48 @@ type ProcessingOptions struct {
 	Zoom         float64
 	TargetSizes  [][2]int
 	DebugOverlay bool
+}
+
+// analysisResultSchema is the JSON Schema (draft 2020-12) of AnalysisResult
+const analysisResultSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "AnalysisResult",
+  "type": "object",
+  "required": ["primary", "description", "tags"],
+  "properties": {
+    "primary": {"$ref": "#/$defs/primary"},
+    "description": {"type": "string"},
+    "tags": {"type": "array", "items": {"type": "string"}},
+    "detections": {"type": "array", "items": {"$ref": "#/$defs/primary"}}
+  },
+  "$defs": {
+    "unit": {"type": "number", "minimum": 0, "maximum": 1},
+    "box": {
+      "type": "object",
+      "description": "bounding box normalized to the image size",
+      "required": ["x", "y", "w", "h"],
+      "properties": {
+        "x": {"$ref": "#/$defs/unit"},
+        "y": {"$ref": "#/$defs/unit"},
+        "w": {"$ref": "#/$defs/unit"},
+        "h": {"$ref": "#/$defs/unit"}
+      }
+    },
+    "primary": {
+      "type": "object",
+      "required": ["label", "confidence", "box", "cx", "cy"],
+      "properties": {
+        "label": {"type": "string"},
+        "confidence": {"$ref": "#/$defs/unit"},
+        "box": {"$ref": "#/$defs/box"},
+        "cx": {"$ref": "#/$defs/unit"},
+        "cy": {"$ref": "#/$defs/unit"}
+      }
+    }
+  }
+}`
+
+// JSONSchema returns a JSON Schema document for AnalysisResult, e.g. for constrained decoding
+func JSONSchema() string {
+	return analysisResultSchema
 }
\ No newline at end of file